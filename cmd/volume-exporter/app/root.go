@@ -1,9 +1,12 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,14 +31,64 @@ const (
 )
 
 type VolumeExporterOption struct {
-	port       int32
-	kubeconfig string
+	port           int32
+	kubeconfig     string
+	nodeName       string
+	kubeletRootDir string
+	hostPrefix     string
+	mountInfoPath  string
+
+	collectEphemeralVolumes  bool
+	storageClassUsageMethods map[string]string
+	duInterval               time.Duration
+	duConcurrency            int
+	duTimeout                time.Duration
+	emptyDirDuInterval       time.Duration
+	statTimeout              time.Duration
+	statWorkers              int
+	collectInterval          time.Duration
+	collectJitter            float64
+	maxStaleness             time.Duration
+	collectionMode           string
+	cacheTTL                 time.Duration
+	scrapeTimeout            time.Duration
+	extraLabels              []string
+	pvcLabelsAllowlist       []string
+	pvcAnnotationsAllowlist  []string
+	pvcLabelsOnStats         bool
+	metricPrefix             string
+	legacyMetrics            bool
+	sampleTimestamps         bool
+	maxStatsAge              time.Duration
+	shutdownGracePeriod      time.Duration
 }
 
+// DefaultShutdownGracePeriod is how long the in-flight scrapes and the controller may take to finish
+// on shutdown, it is within the default terminationGracePeriodSeconds of pods.
+const DefaultShutdownGracePeriod = 10 * time.Second
+
 func NewVolumeExporterOption() *VolumeExporterOption {
 
 	return &VolumeExporterOption{
-		port: 9876,
+		port:           9876,
+		nodeName:       os.Getenv("NODE_NAME"),
+		kubeletRootDir: controller.DefaultKubeletRootDir,
+		duInterval:     controller.DefaultDuInterval,
+		duConcurrency:  controller.DefaultDuConcurrency,
+		duTimeout:      controller.DefaultDuTimeout,
+		statTimeout:    controller.DefaultStatTimeout,
+		statWorkers:    controller.DefaultStatWorkers,
+
+		emptyDirDuInterval: controller.DefaultEmptyDirDuInterval,
+
+		collectInterval: controller.DefaultCollectInterval,
+		collectJitter:   controller.DefaultCollectJitter,
+		collectionMode:  controller.CollectionModeBackground,
+		cacheTTL:        controller.DefaultCacheTTL,
+		scrapeTimeout:   controller.DefaultScrapeTimeout,
+		metricPrefix:    controller.DefaultMetricPrefix,
+
+		shutdownGracePeriod: DefaultShutdownGracePeriod,
 	}
 }
 
@@ -47,14 +100,22 @@ func NewExporterCommand() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			flag.Parse()
 
-			nodename := getHostName()
-
 			cli, err := buildClientset(opt.kubeconfig)
 			if err != nil {
 				cmd.Usage()
 				klog.Fatalf("build clientset failed, err %v", err)
 			}
 
+			nodename := opt.nodeName
+			if nodename == "" {
+				nodename = getHostName()
+				klog.Warningf("neither --node-name nor NODE_NAME is set, using hostname %s as node name", nodename)
+			}
+			if _, err := cli.CoreV1().Nodes().Get(nodename, v1.GetOptions{}); err != nil {
+				klog.Fatalf("get node %s failed, the pods on it can not be watched, err: %v", nodename, err)
+			}
+			klog.Infof("watching pods on node %s", nodename)
+
 			podInformer := coreinformer.NewFilteredPodInformer(
 				cli,
 				AllNamespace,
@@ -66,36 +127,142 @@ func NewExporterCommand() *cobra.Command {
 				},
 			)
 
+			// pvcs and pvs can not be filtered by the node they are used on, the whole cluster is watched
+			pvcInformer := coreinformer.NewPersistentVolumeClaimInformer(
+				cli,
+				AllNamespace,
+				time.Second*30,
+				cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+			)
+
+			pvInformer := coreinformer.NewPersistentVolumeInformer(
+				cli,
+				time.Second*30,
+				cache.Indexers{},
+			)
+
 			c, err := controller.NewVolumeController(
 				cli,
-				podInformer)
+				podInformer,
+				pvcInformer,
+				pvInformer,
+				controller.VolumeControllerConfig{
+					KubeletRootDir: opt.kubeletRootDir,
+					HostPrefix:     opt.hostPrefix,
+					MountInfoPath:  opt.mountInfoPath,
+
+					CollectEphemeralVolumes:  opt.collectEphemeralVolumes,
+					StorageClassUsageMethods: opt.storageClassUsageMethods,
+					DuInterval:               opt.duInterval,
+					DuConcurrency:            opt.duConcurrency,
+					DuTimeout:                opt.duTimeout,
+					EmptyDirDuInterval:       opt.emptyDirDuInterval,
+					StatTimeout:              opt.statTimeout,
+					StatWorkers:              opt.statWorkers,
+					CollectInterval:          opt.collectInterval,
+					CollectJitter:            opt.collectJitter,
+					MaxStaleness:             opt.maxStaleness,
+					CollectionMode:           opt.collectionMode,
+					CacheTTL:                 opt.cacheTTL,
+					ScrapeTimeout:            opt.scrapeTimeout,
+					ExtraLabels:              opt.extraLabels,
+					PVCLabelsAllowlist:       opt.pvcLabelsAllowlist,
+					PVCAnnotationsAllowlist:  opt.pvcAnnotationsAllowlist,
+					PVCLabelsOnStats:         opt.pvcLabelsOnStats,
+					MetricPrefix:             opt.metricPrefix,
+					LegacyMetrics:            opt.legacyMetrics,
+					SampleTimestamps:         opt.sampleTimestamps,
+					MaxStatsAge:              opt.maxStatsAge,
+				})
 			if err != nil {
 				cmd.Usage()
 				klog.Fatalf("new volume controller failed, err %v", err)
 			}
 
 			stop := make(chan struct{})
+			signals := make(chan os.Signal, 2)
+			signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
 			go podInformer.Run(stop)
+			go pvcInformer.Run(stop)
+			go pvInformer.Run(stop)
 
-			go c.Run(stop)
+			controllerStopped := make(chan struct{})
+			go func() {
+				defer close(controllerStopped)
+				if err := c.Run(stop); err != nil {
+					klog.Errorf("run volume controller error, err: %v", err)
+				}
+			}()
 
 			collector := controller.NewVolumeStatsCollector(c)
 			prometheus.Register(collector)
 			http.Handle("/metrics", promhttp.Handler())
+			http.Handle("/healthz", c.HealthzHandler())
+			http.Handle("/readyz", c.ReadyzHandler())
+			server := &http.Server{Addr: fmt.Sprintf(":%d", opt.port)}
 			go func() {
 				klog.Infof("starting http server, listening on :%d", opt.port)
-				if err := http.ListenAndServe(fmt.Sprintf(":%d", opt.port), nil); err != nil && err != http.ErrServerClosed {
+				if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 					klog.Fatalf("start http server error, err: %v", err)
 				}
 			}()
 
-			<-stop
+			sig := <-signals
+			klog.Infof("received signal %v, shutting down within %v", sig, opt.shutdownGracePeriod)
+			go func() {
+				sig := <-signals
+				klog.Errorf("received signal %v again, exiting immediately", sig)
+				klog.Flush()
+				os.Exit(1)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), opt.shutdownGracePeriod)
+			defer cancel()
+			// the in-flight scrapes are served before the controller they read from is stopped
+			if err := server.Shutdown(ctx); err != nil {
+				klog.Errorf("shut down http server error, err: %v", err)
+			}
+			close(stop)
+			select {
+			case <-controllerStopped:
+			case <-ctx.Done():
+				klog.Warningf("volume controller is not stopped within %v", opt.shutdownGracePeriod)
+			}
+			klog.Infof("volume exporter is stopped")
+			klog.Flush()
 		},
 	}
 
 	flag.Int32Var(&opt.port, "port", opt.port, "the port that exporter listen to")
 	flag.StringVar(&opt.kubeconfig, "kubeconfig", opt.kubeconfig, "the path of kubeconfig file")
+	flag.StringVar(&opt.nodeName, "node-name", opt.nodeName, "the name of the node whose pods are watched, defaults to the NODE_NAME env")
+	flag.StringVar(&opt.kubeletRootDir, "kubelet-root-dir", opt.kubeletRootDir, "the --root-dir of kubelet on the node")
+	flag.StringVar(&opt.hostPrefix, "host-prefix", opt.hostPrefix, "the path where the host filesystem is mounted in the container, e.g. /host")
+	flag.StringVar(&opt.mountInfoPath, "mountinfo-path", opt.mountInfoPath, "the mountinfo file to discover volume mounts from, defaults to /proc/1/mountinfo or /proc/self/mountinfo")
+	flag.BoolVar(&opt.collectEphemeralVolumes, "collect-ephemeral-volumes", opt.collectEphemeralVolumes, "collect stats of emptyDir and generic ephemeral volumes")
+	flag.StringToStringVar(&opt.storageClassUsageMethods, "storageclass-usage-method", opt.storageClassUsageMethods, "the usage method of volumes per storage class, e.g. nfs-client=du,cephfs=both, valid methods are statfs, du and both")
+	flag.DurationVar(&opt.duInterval, "du-interval", opt.duInterval, "how often du runs for a volume whose usage method is du or both")
+	flag.IntVar(&opt.duConcurrency, "du-concurrency", opt.duConcurrency, "the max number of du running at the same time")
+	flag.DurationVar(&opt.duTimeout, "du-timeout", opt.duTimeout, "the deadline of a du run on a volume, du is killed at it and volumes whose du times out are retried with backoff")
+	flag.DurationVar(&opt.emptyDirDuInterval, "emptydir-du-interval", opt.emptyDirDuInterval, "how often du runs for a disk backed emptyDir volume, it is shorter than --du-interval to warn before kubelet evicts the pod on the size limit")
+	flag.DurationVar(&opt.statTimeout, "stat-timeout", opt.statTimeout, "the deadline of a stat call on a volume, volumes that time out repeatedly are marked stale and retried with backoff")
+	flag.IntVar(&opt.statWorkers, "stat-workers", opt.statWorkers, "the max number of stat calls running at the same time")
+	flag.DurationVar(&opt.collectInterval, "collect-interval", opt.collectInterval, "how often the stats of all the volumes on the node are calculated")
+	flag.Float64Var(&opt.collectJitter, "collect-jitter", opt.collectJitter, "the max fraction of --collect-interval added to the wait between two collections")
+	flag.DurationVar(&opt.maxStaleness, "max-staleness", opt.maxStaleness, "if set, a scrape calculates the stats first when they are older than this, e.g. because the scrape interval is shorter than --collect-interval")
+	flag.StringVar(&opt.collectionMode, "collection-mode", opt.collectionMode, "background calculates the stats every --collect-interval, on-scrape calculates them when they are scraped")
+	flag.DurationVar(&opt.cacheTTL, "cache-ttl", opt.cacheTTL, "how long the stats calculated by a scrape are reused in on-scrape mode")
+	flag.DurationVar(&opt.scrapeTimeout, "scrape-timeout", opt.scrapeTimeout, "how long a scrape waits for the stats it calculates, the stats not ready in time are reported from the last calculation")
+	flag.StringSliceVar(&opt.extraLabels, "extra-labels", opt.extraLabels, "labels added to the pvc stats, any of storageclass, persistentvolume, csi_driver, volume_handle, access_modes, node and pod")
+	flag.StringSliceVar(&opt.pvcLabelsAllowlist, "pvc-labels-allowlist", opt.pvcLabelsAllowlist, "keys of the pvc labels reported by volume_exporter_persistentvolumeclaim_labels as label_<key>, e.g. team,cost-center")
+	flag.StringSliceVar(&opt.pvcAnnotationsAllowlist, "pvc-annotations-allowlist", opt.pvcAnnotationsAllowlist, "keys of the pvc annotations reported by volume_exporter_persistentvolumeclaim_annotations as annotation_<key>")
+	flag.BoolVar(&opt.pvcLabelsOnStats, "pvc-labels-on-stats", opt.pvcLabelsOnStats, "add the labels in --pvc-labels-allowlist to the pvc stats as well")
+	flag.StringVar(&opt.metricPrefix, "metric-prefix", opt.metricPrefix, "the prefix of the pvc stats, the default kubelet keeps the names of kubelet_volume_stats_*, which collide with the metrics of kubelet itself")
+	flag.BoolVar(&opt.legacyMetrics, "legacy-metrics", opt.legacyMetrics, "emit the pvc stats as kubelet_volume_stats_* as well as under --metric-prefix while dashboards are migrated")
+	flag.BoolVar(&opt.sampleTimestamps, "sample-timestamps", opt.sampleTimestamps, "attach the time the volume stats were measured at to their samples instead of the scrape time")
+	flag.DurationVar(&opt.maxStatsAge, "max-stats-age", opt.maxStatsAge, "drop the stats of a volume which have not been updated for longer than this instead of repeating them, 0 disables it")
+	flag.DurationVar(&opt.shutdownGracePeriod, "shutdown-grace-period", opt.shutdownGracePeriod, "how long the in-flight scrapes and the volume controller may take to finish after SIGTERM")
 
 	return cmd
 }
@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+const (
+	// CollectionModeBackground calculates the stats every collect interval, scrapes read the latest ones
+	CollectionModeBackground = "background"
+	// CollectionModeOnScrape calculates the stats when they are scraped, nothing runs between scrapes
+	CollectionModeOnScrape = "on-scrape"
+
+	DefaultCollectInterval = 15 * time.Second
+	DefaultCollectJitter   = 0.1
+	DefaultCacheTTL        = 5 * time.Second
+	DefaultScrapeTimeout   = 8 * time.Second
+)
+
+// collectScheduler calculates the stats of all the watched pods in rounds. In background mode a round
+// runs every interval, in on-scrape mode the scrapes start them, so the number of goroutines does not
+// grow with the number of pods on the node either way.
+type collectScheduler struct {
+	mode     string
+	interval time.Duration
+	// jitter is the max fraction of interval added to the wait between rounds
+	jitter float64
+	// maxStaleness makes a scrape run a round first if the last one finished longer ago, 0 disables it.
+	// It is the ttl of the stats in on-scrape mode.
+	maxStaleness time.Duration
+	// scrapeTimeout is how long a scrape waits for the round it runs, the stats that are not calculated
+	// in time are reported from the last round
+	scrapeTimeout time.Duration
+	workers       int
+	calculators   func() []*volumeStatCalculator
+
+	lock      sync.Mutex
+	lastRound time.Time
+	// running is closed when the round in progress completes, it is nil if no round is running
+	running chan struct{}
+	// stopped is set by Stop, no round is started after it
+	stopped bool
+}
+
+func newCollectScheduler(mode string, interval time.Duration, jitter float64, maxStaleness, scrapeTimeout time.Duration, workers int, calculators func() []*volumeStatCalculator) *collectScheduler {
+	if interval <= 0 {
+		interval = DefaultCollectInterval
+	}
+	if jitter < 0 {
+		jitter = 0
+	}
+	if scrapeTimeout <= 0 {
+		scrapeTimeout = DefaultScrapeTimeout
+	}
+	if workers <= 0 {
+		workers = DefaultStatWorkers
+	}
+	return &collectScheduler{
+		mode:          mode,
+		interval:      interval,
+		jitter:        jitter,
+		maxStaleness:  maxStaleness,
+		scrapeTimeout: scrapeTimeout,
+		workers:       workers,
+		calculators:   calculators,
+	}
+}
+
+// isValidCollectionMode returns whether mode is a supported collection mode.
+func isValidCollectionMode(mode string) bool {
+	return mode == CollectionModeBackground || mode == CollectionModeOnScrape
+}
+
+// Run starts a round every interval until stop is closed. Only the first round is started in on-scrape mode.
+func (s *collectScheduler) Run(stop <-chan struct{}) {
+	if s.mode == CollectionModeOnScrape {
+		klog.Infof("collecting volume stats on scrape, ttl: %v, timeout: %v", s.maxStaleness, s.scrapeTimeout)
+		// the first round makes the exporter ready before it is scraped
+		if done := s.start(0); done != nil {
+			<-done
+		}
+		<-stop
+		return
+	}
+
+	klog.Infof("collecting volume stats every %v, jitter: %v, max staleness: %v", s.interval, s.jitter, s.maxStaleness)
+	wait.JitterUntil(func() {
+		if done := s.start(0); done != nil {
+			<-done
+		}
+	}, s.interval, s.jitter, true, stop)
+}
+
+// Refresh runs a round unless one has finished within maxStaleness, and waits for it until the scrape
+// timeout. A round in progress is joined instead, so concurrent scrapes do not multiply the stats.
+// It does nothing if maxStaleness is not set.
+func (s *collectScheduler) Refresh() {
+	if s.maxStaleness <= 0 {
+		return
+	}
+	done := s.start(s.maxStaleness)
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(s.scrapeTimeout):
+		klog.Warningf("collecting volume stats takes longer than %v, stats of the last round are reported", s.scrapeTimeout)
+	}
+}
+
+// Stop stops starting rounds, including those of the scrapes, and waits for the round in progress
+// to complete.
+func (s *collectScheduler) Stop() {
+	s.lock.Lock()
+	s.stopped = true
+	running := s.running
+	s.lock.Unlock()
+
+	if running != nil {
+		klog.Infof("waiting for the collection round in progress to complete")
+		<-running
+	}
+}
+
+// LastRound returns when the last round finished, it is zero before the first one finishes.
+func (s *collectScheduler) LastRound() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastRound
+}
+
+// start starts a round in the background unless one is running or the last one finished within
+// maxAge. It returns the channel closed when the round completes, or nil if the stats are fresh or
+// the scheduler is stopped.
+func (s *collectScheduler) start(maxAge time.Duration) <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return nil
+	}
+	if s.running != nil {
+		return s.running
+	}
+	if maxAge > 0 && time.Since(s.lastRound) <= maxAge {
+		return nil
+	}
+
+	done := make(chan struct{})
+	s.running = done
+	go func() {
+		s.round()
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.lastRound = time.Now()
+		s.running = nil
+		close(done)
+	}()
+	return done
+}
+
+// round calculates the stats of all the pods, the stats of a pod are stored as soon as they are ready.
+func (s *collectScheduler) round() {
+	start := time.Now()
+	calculators := s.calculators()
+	workqueue.Parallelize(s.workers, len(calculators), func(i int) {
+		calculatorGoroutines.Inc()
+		defer calculatorGoroutines.Dec()
+		calculators[i].calcAndStoreStats()
+	})
+	klog.V(4).Infof("collected stats of %d pods in %v", len(calculators), time.Since(start))
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"fmt"
+	goruntime "runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	benchmarkPods = 1000
+	// perPodPeriod and perPodJitter are the period and the jitter of the per-pod tickers the
+	// calculators ran on before the collect scheduler
+	perPodPeriod = time.Second
+	perPodJitter = 1.0
+)
+
+// newBenchmarkController returns a controller tracking pods, each with its own volume, whose volumes
+// are resolved already. The stats are shared between the pods for half of collectInterval.
+func newBenchmarkController(b *testing.B, pods int, collectInterval time.Duration, collectJitter float64) *testController {
+	var objects []runtime.Object
+	for i := 0; i < pods; i++ {
+		objects = append(objects,
+			newTestClaim(fmt.Sprintf("data-web-%d", i), fmt.Sprintf("pv-%d", i)),
+			newTestHostPathPV(fmt.Sprintf("pv-%d", i), b.TempDir()))
+	}
+	tc := newTestController(b, VolumeControllerConfig{CollectInterval: collectInterval, CollectJitter: collectJitter}, objects...)
+	for i := 0; i < pods; i++ {
+		name := fmt.Sprintf("web-%d", i)
+		tc.sync(b, testNamespace+"/"+name, newTestPod(name, types.UID(name), "data-"+name))
+	}
+	tc.scheduler.round()
+	return tc
+}
+
+// cpuTime returns the user and system time the process has used.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// benchmarkCollect runs the collection loops started by start on benchmarkPods pods, whose stats are
+// calculated every period plus up to jitter of it. Every iteration of b is the mean wait between two
+// calculations, so the loops run as long as they would on a node, e.g. -benchtime 10x runs about ten
+// rounds. It reports the cpu time used per wall-clock second, the stats calculated per second and the
+// goroutines the loops add. start returns the loops' wait group, calcs counts the stats of the pods
+// they calculate.
+func benchmarkCollect(b *testing.B, period time.Duration, jitter float64, start func(tc *testController, stop <-chan struct{}, calcs *int64) *sync.WaitGroup) {
+	tc := newBenchmarkController(b, benchmarkPods, period, jitter)
+	baseline := goruntime.NumGoroutine()
+	window := time.Duration(b.N) * (period + time.Duration(float64(period)*jitter/2))
+	stop := make(chan struct{})
+	var calcs int64
+
+	b.ResetTimer()
+	cpu := cpuTime(b)
+	loops := start(tc, stop, &calcs)
+	time.Sleep(window / 2)
+	goroutines := goruntime.NumGoroutine() - baseline
+	time.Sleep(window - window/2)
+	close(stop)
+	loops.Wait()
+	cpu = cpuTime(b) - cpu
+	b.StopTimer()
+
+	if calcs == 0 {
+		b.Fatalf("no stats are calculated")
+	}
+	b.ReportMetric(float64(cpu.Milliseconds())/window.Seconds(), "cpu-ms/s")
+	b.ReportMetric(float64(calcs)/window.Seconds(), "stats/s")
+	b.ReportMetric(float64(goroutines), "goroutines")
+}
+
+// BenchmarkCollectPerPodTicker calculates the stats of every pod in its own goroutine on its own
+// jittered ticker, as the calculators did before the collect scheduler.
+func BenchmarkCollectPerPodTicker(b *testing.B) {
+	benchmarkCollect(b, perPodPeriod, perPodJitter, func(tc *testController, stop <-chan struct{}, calcs *int64) *sync.WaitGroup {
+		var loops sync.WaitGroup
+		for _, calculator := range tc.calculators() {
+			loops.Add(1)
+			go func(calculator *volumeStatCalculator) {
+				defer loops.Done()
+				wait.JitterUntil(func() {
+					calculator.calcAndStoreStats()
+					atomic.AddInt64(calcs, 1)
+				}, perPodPeriod, perPodJitter, true, stop)
+			}(calculator)
+		}
+		return &loops
+	})
+}
+
+// BenchmarkCollectSchedulerRound calculates the stats of all the pods in rounds every
+// DefaultCollectInterval, as the collect scheduler does in background mode.
+func BenchmarkCollectSchedulerRound(b *testing.B) {
+	benchmarkCollect(b, DefaultCollectInterval, DefaultCollectJitter, func(tc *testController, stop <-chan struct{}, calcs *int64) *sync.WaitGroup {
+		var loops sync.WaitGroup
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			wait.JitterUntil(func() {
+				tc.scheduler.round()
+				atomic.AddInt64(calcs, int64(len(tc.calculators())))
+			}, tc.scheduler.interval, tc.scheduler.jitter, true, stop)
+		}()
+		return &loops
+	})
+}
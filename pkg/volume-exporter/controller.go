@@ -2,44 +2,248 @@ package controller
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// coreinformer "k8s.io/client-go/informers/core/v1"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/util/wait"
-	// "k8s.io/apimachinery/pkg/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	// "k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelister "k8s.io/client-go/listers/core/v1"
 	cache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 )
 
+// VolumeControllerConfig holds the node specific settings of VolumeController.
+type VolumeControllerConfig struct {
+	// KubeletRootDir is the --root-dir that kubelet runs with
+	KubeletRootDir string
+	// HostPrefix is the directory where the host filesystem is mounted in the exporter container,
+	// it is empty if the kubelet directories are mounted at the same paths as on the host
+	HostPrefix string
+	// MountInfoPath is the mountinfo file to discover volume mounts from, the mountinfo of the host
+	// PID namespace or of the exporter itself is used if it is empty
+	MountInfoPath string
+	// CollectEphemeralVolumes enables the collection of emptyDir and generic ephemeral volumes
+	CollectEphemeralVolumes bool
+	// StorageClassUsageMethods maps storage classes to the usage method of their volumes
+	StorageClassUsageMethods map[string]string
+	// DuInterval is how often du runs for a volume
+	DuInterval time.Duration
+	// DuConcurrency is the max number of du running at the same time
+	DuConcurrency int
+	// DuTimeout is the deadline of a du run on a volume
+	DuTimeout time.Duration
+	// EmptyDirDuInterval is how often du runs for a disk backed emptyDir volume
+	EmptyDirDuInterval time.Duration
+	// StatTimeout is the deadline of a stat call on a volume
+	StatTimeout time.Duration
+	// StatWorkers is the max number of stat calls running at the same time
+	StatWorkers int
+	// CollectInterval is how often the stats of all the volumes are calculated
+	CollectInterval time.Duration
+	// CollectJitter is the max fraction of CollectInterval added to the wait between two rounds
+	CollectJitter float64
+	// MaxStaleness makes a scrape calculate the stats first if they are older, 0 disables it
+	MaxStaleness time.Duration
+	// CollectionMode is background or on-scrape, it defaults to background
+	CollectionMode string
+	// CacheTTL is how long the stats calculated by a scrape are reused in on-scrape mode
+	CacheTTL time.Duration
+	// ScrapeTimeout is how long a scrape waits for the stats it calculates
+	ScrapeTimeout time.Duration
+	// ExtraLabels are added to the pvc stats, e.g. storageclass, persistentvolume or node
+	ExtraLabels []string
+	// PVCLabelsAllowlist and PVCAnnotationsAllowlist are the keys of the pvc labels and annotations
+	// reported by the persistentvolumeclaim_labels and persistentvolumeclaim_annotations metrics
+	PVCLabelsAllowlist      []string
+	PVCAnnotationsAllowlist []string
+	// PVCLabelsOnStats adds the allowed pvc labels to the pvc stats as well
+	PVCLabelsOnStats bool
+	// MetricPrefix is the prefix of the pvc stats, it defaults to kubelet which makes them look
+	// like the kubelet_volume_stats_* metrics of kubelet
+	MetricPrefix string
+	// LegacyMetrics emits the pvc stats under the kubelet prefix as well as under MetricPrefix, so
+	// dashboards can move to the new names gradually
+	LegacyMetrics bool
+	// SampleTimestamps attaches the time the stats were measured at to their samples
+	SampleTimestamps bool
+	// MaxStatsAge drops the stats of a volume which have not been updated for longer, 0 disables it.
+	// du stats are given another du interval.
+	MaxStatsAge time.Duration
+}
+
 type VolumeController struct {
-	cli       *kubernetes.Clientset
+	cli       kubernetes.Interface
 	podLister corelister.PodLister
 	podSynced cache.InformerSynced
+	pvcLister corelister.PersistentVolumeClaimLister
+	pvcSynced cache.InformerSynced
+	pvLister  corelister.PersistentVolumeLister
+	pvSynced  cache.InformerSynced
+	resolver  *volumePathResolver
+	mounts    *mountTable
+	recorder  record.EventRecorder
+	du        *duScheduler
+	pool      *statPool
+	registry  *volumeRegistry
+	scheduler *collectScheduler
+
+	// eventBroadcaster sends the events of recorder to eventWatches, which log them and record them to
+	// the api server. They are stopped with the controller.
+	eventBroadcaster record.EventBroadcaster
+	eventWatches     []watch.Interface
+
+	collectEphemeral         bool
+	emptyDirDuInterval       time.Duration
+	storageClassUsageMethods map[string]string
+	extraLabels              []string
+	pvcLabels                []string
+	pvcAnnotations           []string
+	pvcLabelsOnStats         bool
+	metricPrefix             string
+	legacyMetrics            bool
+	sampleTimestamps         bool
+	maxStatsAge              time.Duration
 
 	queue workqueue.RateLimitingInterface
 
 	podToVolumes map[string]*volumeStatCalculator
 	lock         sync.Mutex
+	// retryKeys holds the pods requeued since their pvc or pv changed, their volumes which are not
+	// ready are retried without waiting for the backoff. It is guarded by lock.
+	retryKeys sets.String
+
+	// synced is set to 1 once the informer caches are synced
+	synced int32
+	// processing holds when the workers started to sync the pods they are syncing
+	processing     map[string]time.Time
+	processingLock sync.Mutex
+
+	// store holds the latest stats of podToVolumes, it is read by the collector without taking lock
+	store *statsStore
 }
 
 func NewVolumeController(
-	cli *kubernetes.Clientset,
+	cli kubernetes.Interface,
 	podInformer cache.SharedIndexInformer,
+	pvcInformer cache.SharedIndexInformer,
+	pvInformer cache.SharedIndexInformer,
+	config VolumeControllerConfig,
 ) (*VolumeController, error) {
+	for class, method := range config.StorageClassUsageMethods {
+		if !isValidUsageMethod(method) {
+			return nil, fmt.Errorf("invalid usage method %q of storage class %s, valid methods are statfs, du and both", method, class)
+		}
+	}
+
+	extraLabels := sets.NewString()
+	for _, label := range config.ExtraLabels {
+		if !isValidExtraLabel(label) {
+			return nil, fmt.Errorf("invalid extra label %q, valid labels are %s", label, strings.Join(sets.StringKeySet(volumeStatsExtraLabels).List(), ", "))
+		}
+		if extraLabels.Has(label) {
+			return nil, fmt.Errorf("extra label %q is given more than once", label)
+		}
+		extraLabels.Insert(label)
+	}
+	if _, err := pvcMetadataLabelNames(pvcLabelPrefix, config.PVCLabelsAllowlist); err != nil {
+		return nil, fmt.Errorf("invalid pvc labels allowlist, %v", err)
+	}
+	if _, err := pvcMetadataLabelNames(pvcAnnotationPrefix, config.PVCAnnotationsAllowlist); err != nil {
+		return nil, fmt.Errorf("invalid pvc annotations allowlist, %v", err)
+	}
+
+	metricPrefix := config.MetricPrefix
+	if metricPrefix == "" {
+		metricPrefix = DefaultMetricPrefix
+	}
+	if !isValidMetricPrefix(metricPrefix) {
+		return nil, fmt.Errorf("invalid metric prefix %q", metricPrefix)
+	}
+
+	mode := config.CollectionMode
+	if mode == "" {
+		mode = CollectionModeBackground
+	}
+	if !isValidCollectionMode(mode) {
+		return nil, fmt.Errorf("invalid collection mode %q, valid modes are background and on-scrape", mode)
+	}
+	collectInterval, maxStaleness := config.CollectInterval, config.MaxStaleness
+	if collectInterval <= 0 {
+		collectInterval = DefaultCollectInterval
+	}
+	if mode == CollectionModeOnScrape {
+		// the stats are calculated at most once per ttl however many scrapers there are
+		collectInterval, maxStaleness = config.CacheTTL, config.CacheTTL
+		if collectInterval <= 0 {
+			collectInterval, maxStaleness = DefaultCacheTTL, DefaultCacheTTL
+		}
+	}
+
+	emptyDirDuInterval := config.EmptyDirDuInterval
+	if emptyDirDuInterval <= 0 {
+		emptyDirDuInterval = DefaultEmptyDirDuInterval
+	}
+
+	resolver := newVolumePathResolver(config.KubeletRootDir, config.HostPrefix)
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventWatches := []watch.Interface{
+		eventBroadcaster.StartLogging(klog.Infof),
+		eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cli.CoreV1().Events("")}),
+	}
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "volume-exporter"})
+
+	mounts := newMountTable(config.MountInfoPath, resolver)
+	du := newDuScheduler(config.DuInterval, config.DuConcurrency, config.DuTimeout)
+	pool := newStatPool(config.StatTimeout, config.StatWorkers)
+
 	vc := &VolumeController{
-		cli:          cli,
+		cli:      cli,
+		resolver: resolver,
+		mounts:   mounts,
+		recorder: recorder,
+		du:       du,
+		pool:     pool,
+		// a round shares a stat result between the pods using the same volume, the next one stats again
+		registry:     newVolumeRegistry(collectInterval/2, mounts, du, pool),
 		queue:        workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pods"),
 		podToVolumes: make(map[string]*volumeStatCalculator),
+		retryKeys:    sets.NewString(),
+		processing:   make(map[string]time.Time),
+		store:        newStatsStore(),
+
+		collectEphemeral:         config.CollectEphemeralVolumes,
+		emptyDirDuInterval:       emptyDirDuInterval,
+		storageClassUsageMethods: config.StorageClassUsageMethods,
+		extraLabels:              config.ExtraLabels,
+		pvcLabels:                config.PVCLabelsAllowlist,
+		pvcAnnotations:           config.PVCAnnotationsAllowlist,
+		pvcLabelsOnStats:         config.PVCLabelsOnStats,
+		metricPrefix:             metricPrefix,
+		legacyMetrics:            config.LegacyMetrics,
+		sampleTimestamps:         config.SampleTimestamps,
+		maxStatsAge:              config.MaxStatsAge,
 	}
 
+	vc.eventBroadcaster, vc.eventWatches = eventBroadcaster, eventWatches
+	vc.scheduler = newCollectScheduler(mode, collectInterval, config.CollectJitter, maxStaleness, config.ScrapeTimeout, config.StatWorkers, vc.calculators)
+
 	vc.podLister = corelister.NewPodLister(podInformer.GetIndexer())
 	vc.podSynced = podInformer.HasSynced
 
@@ -49,29 +253,82 @@ func NewVolumeController(
 		DeleteFunc: vc.delete,
 	})
 
+	vc.pvcLister = corelister.NewPersistentVolumeClaimLister(pvcInformer.GetIndexer())
+	vc.pvcSynced = pvcInformer.HasSynced
+
+	pvcInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    vc.addPVC,
+		UpdateFunc: vc.updatePVC,
+	})
+
+	vc.pvLister = corelister.NewPersistentVolumeLister(pvInformer.GetIndexer())
+	vc.pvSynced = pvInformer.HasSynced
+
+	pvInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    vc.addPV,
+		UpdateFunc: vc.updatePV,
+	})
+
 	return vc, nil
 }
 
 func (c *VolumeController) Run(stop <-chan struct{}) error {
-	defer c.queue.ShutDown()
-
 	klog.Infof("starting volume controller")
 
 	klog.Infof("waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stop, c.podSynced); !ok {
+	if ok := cache.WaitForCacheSync(stop, c.podSynced, c.pvcSynced, c.pvSynced); !ok {
+		c.queue.ShutDown()
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
+	atomic.StoreInt32(&c.synced, 1)
+
+	if pods, err := c.podLister.List(labels.Everything()); err == nil && len(pods) == 0 {
+		klog.Warningf("no pod is found on the node, check that --node-name matches the name of the node object")
+	}
 
 	klog.Infof("starting workers")
+	var workers sync.WaitGroup
 	for i := 0; i < 2; i++ {
-		go wait.Until(c.runWorker, time.Second, stop)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(c.runWorker, time.Second, stop)
+		}()
 	}
 	klog.Infof("started workers")
+
+	// the first round waits for the pods in the caches to be added, so it covers all of them
+	if err := wait.PollUntil(100*time.Millisecond, func() (bool, error) {
+		return c.queue.Len() == 0, nil
+	}, stop); err == nil {
+		go c.scheduler.Run(stop)
+	}
 	<-stop
 	klog.Infof("shuting down workers")
+	// the workers keep processing the pods already in the queue until it is drained, the queue
+	// may only be shut down once
+	c.queue.ShutDown()
+	workers.Wait()
+	c.scheduler.Stop()
+	c.du.Stop()
+	c.releaseCalculators()
+	c.stopEvents()
+	klog.Infof("volume controller is stopped")
 	return nil
 }
 
+// stopEvents stops sending the events, it is called once nothing records events any more.
+func (c *VolumeController) stopEvents() {
+	for _, w := range c.eventWatches {
+		w.Stop()
+	}
+	// the broadcaster of client-go delivers the events in a goroutine of its own, which only stops
+	// when it is shut down
+	if broadcaster, ok := c.eventBroadcaster.(interface{ Shutdown() }); ok {
+		broadcaster.Shutdown()
+	}
+}
+
 func (c *VolumeController) runWorker() {
 	for c.processNextWorkItem() {
 	}
@@ -108,6 +365,8 @@ func (c *VolumeController) processNextWorkItem() bool {
 			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
 			return nil
 		}
+		c.startProcessing(key)
+		defer c.finishProcessing(key)
 		// Run the syncHandler, passing it the namespace/name string of the
 		// Foo resource to be synced.
 		if err := c.syncHandler(key); err != nil {
@@ -130,6 +389,20 @@ func (c *VolumeController) processNextWorkItem() bool {
 	return true
 }
 
+// startProcessing records that a worker starts to sync key, it is checked by /healthz.
+func (c *VolumeController) startProcessing(key string) {
+	c.processingLock.Lock()
+	defer c.processingLock.Unlock()
+	c.processing[key] = time.Now()
+}
+
+// finishProcessing records that the worker syncing key has finished.
+func (c *VolumeController) finishProcessing(key string) {
+	c.processingLock.Lock()
+	defer c.processingLock.Unlock()
+	delete(c.processing, key)
+}
+
 func (c *VolumeController) syncHandler(key string) error {
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
@@ -137,6 +410,7 @@ func (c *VolumeController) syncHandler(key string) error {
 		return nil
 	}
 
+	retry := c.takeRetry(key)
 	isDeletion := false
 	pod, err := c.podLister.Pods(namespace).Get(name)
 	if err != nil {
@@ -149,8 +423,15 @@ func (c *VolumeController) syncHandler(key string) error {
 		}
 	}
 
+	if !isDeletion && isPodInactive(pod) {
+		// completed and terminating pods keep their volumes for a while, their stats must
+		// not shadow the pods which are still using the same pvcs
+		klog.Infof("pod %s/%s is in phase %s and deleting: %v", namespace, name, pod.Status.Phase, pod.DeletionTimestamp != nil)
+		isDeletion = true
+	}
+
 	if isDeletion {
-		if _, ok := c.podToVolumes[key]; ok {
+		if c.podExists(key) {
 			klog.Infof("delete pod %s/%s from volume controller", namespace, name)
 			if err = c.deletePod(key); err != nil {
 				klog.Errorf("delete pod %s/%s from volume controller failed, err: %v", namespace, name, err)
@@ -161,7 +442,7 @@ func (c *VolumeController) syncHandler(key string) error {
 		return nil
 	}
 
-	err = c.addPod(pod, key)
+	err = c.addPod(pod, key, retry)
 	if err != nil {
 		klog.Errorf("add pod %s/%s into volume controller failed, err: %v", pod.Namespace, pod.Name, err)
 		return err
@@ -170,28 +451,48 @@ func (c *VolumeController) syncHandler(key string) error {
 	return nil
 }
 
-func (c *VolumeController) addPod(pod *v1.Pod, key string) error {
-	if c.podExists(key) {
-		klog.Infof("pod %s/%s has already been added into controller", pod.Namespace, pod.Name)
-		return nil
+// addPod starts to calculate the stats of pod, or updates the pod already added. retry is set if the
+// pod is synced since its pvc or pv changed.
+func (c *VolumeController) addPod(pod *v1.Pod, key string, retry bool) error {
+	if uid, ok := c.podUID(key); ok {
+		if uid == pod.UID {
+			klog.Infof("pod %s/%s has already been added into controller", pod.Namespace, pod.Name)
+			c.store.SetPod(key, pod)
+			c.addPodVolumes(key, c.collectedVolumes(pod))
+			// the volumes that are not ready are retried when their pvc or pv changes, the updates
+			// and the resyncs of the pod keep their backoff
+			if retry {
+				c.retryPodVolumes(key)
+			}
+			return nil
+		}
+		// the pod is recreated with the same name, e.g. by a statefulset, before its deletion is
+		// handled, the volumes of the old pod are no longer mounted
+		klog.Infof("pod %s/%s is recreated, uid changes from %s to %s", pod.Namespace, pod.Name, uid, pod.UID)
+		if err := c.deletePod(key); err != nil {
+			return err
+		}
 	}
 
-	provider, err := newVolumesMetricProvider(c.cli, pod)
-	if err != nil {
-		klog.Errorf("new volumeMetricProvider for pod [%s/%s] failed, err: %v", pod.Namespace, pod.Name, err)
-		return err
-	}
+	provider := c.newVolumesMetricProvider(pod)
 
-	calcultor := newVolumeStatCalculator(provider, time.Second, pod)
+	calcultor := newVolumeStatCalculator(provider, pod, c.registry, c.recorder, c.store, key)
 
 	klog.Infof("pod %s/%s is successfully added into controller", pod.Namespace, pod.Name)
 	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	if _, ok := c.podToVolumes[key]; !ok {
-		c.podToVolumes[key] = calcultor.StartOnce()
+	old, ok := c.podToVolumes[key]
+	if ok && old.pod.UID == pod.UID {
+		c.lock.Unlock()
+		return nil
 	}
+	c.store.Add(key, pod)
+	c.podToVolumes[key] = calcultor
+	c.lock.Unlock()
 
+	// the old provider is released without holding lock, which the scrapes take
+	if ok {
+		old.provider.Release()
+	}
 	return nil
 }
 
@@ -203,13 +504,100 @@ func (c *VolumeController) deletePod(key string) error {
 
 	klog.Infof("pod [%s] is deleted from controller", key)
 	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.podToVolumes[key].StopOnce()
+	calculator, ok := c.podToVolumes[key]
 	delete(c.podToVolumes, key)
+	c.store.Delete(key)
+	c.lock.Unlock()
 
+	if ok {
+		calculator.provider.Release()
+	}
 	return nil
 }
 
+// releaseCalculators releases the volumes of all the pods, it is called once the controller is stopped.
+func (c *VolumeController) releaseCalculators() {
+	c.lock.Lock()
+	released := make([]*volumeStatCalculator, 0, len(c.podToVolumes))
+	for key, calculator := range c.podToVolumes {
+		released = append(released, calculator)
+		delete(c.podToVolumes, key)
+		c.store.Delete(key)
+	}
+	c.lock.Unlock()
+
+	for _, calculator := range released {
+		calculator.provider.Release()
+	}
+}
+
+// calculators returns the calculators of all the pods in the controller.
+func (c *VolumeController) calculators() []*volumeStatCalculator {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	calculators := make([]*volumeStatCalculator, 0, len(c.podToVolumes))
+	for _, calculator := range c.podToVolumes {
+		calculators = append(calculators, calculator)
+	}
+	return calculators
+}
+
+// isPodInactive returns whether the pod has terminated or is being deleted.
+func isPodInactive(pod *v1.Pod) bool {
+	return pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed || pod.DeletionTimestamp != nil
+}
+
+// addPodVolumes tracks the volumes of the pod which are collected now but were not when it was added.
+func (c *VolumeController) addPodVolumes(key string, specs map[string]v1.Volume) {
+	if calculator, ok := c.calculator(key); ok {
+		calculator.provider.AddVolumes(specs)
+	}
+}
+
+// retryPodVolumes retries the volumes of the pod that are not ready without waiting for their backoff.
+func (c *VolumeController) retryPodVolumes(key string) {
+	if calculator, ok := c.calculator(key); ok {
+		calculator.provider.RetryNow()
+	}
+}
+
+// markRetry makes the next sync of the pod for key retry its volumes which are not ready.
+func (c *VolumeController) markRetry(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.retryKeys.Insert(key)
+}
+
+// takeRetry returns whether the pod for key is marked by markRetry, and clears the mark.
+func (c *VolumeController) takeRetry(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.retryKeys.Has(key) {
+		return false
+	}
+	c.retryKeys.Delete(key)
+	return true
+}
+
+// calculator returns the calculator of the pod for key. Its provider must be called after lock is
+// released, since the provider takes a lock of its own.
+func (c *VolumeController) calculator(key string) (*volumeStatCalculator, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	calculator, ok := c.podToVolumes[key]
+	return calculator, ok
+}
+
+// podUID returns the uid of the pod whose volumes are calculated for key.
+func (c *VolumeController) podUID(key string) (types.UID, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if calculator, ok := c.podToVolumes[key]; ok {
+		return calculator.pod.UID, true
+	}
+	return "", false
+}
+
 func (c *VolumeController) podExists(key string) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -255,3 +643,103 @@ func (c *VolumeController) delete(obj interface{}) {
 	klog.Infof("[ Delete ] action: [%s]", key)
 	c.queue.Add(key)
 }
+
+func (c *VolumeController) addPVC(obj interface{}) {
+	pvc, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	// the pvc of a generic ephemeral volume makes the volume be collected even before it is bound
+	if owner := metav1.GetControllerOf(pvc); pvc.Spec.VolumeName != "" || (owner != nil && owner.Kind == "Pod") {
+		c.enqueuePodsUsingClaim(pvc.Namespace, pvc.Name)
+	}
+}
+
+func (c *VolumeController) updatePVC(oldObj, newObj interface{}) {
+	oldPVC, ok := oldObj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	newPVC, ok := newObj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	// binding changes the volume of the pods, periodic resyncs are ignored
+	if oldPVC.Spec.VolumeName != newPVC.Spec.VolumeName {
+		klog.Infof("[ Bound  ] action: pvc [%s/%s] is bound to pv [%s]", newPVC.Namespace, newPVC.Name, newPVC.Spec.VolumeName)
+		c.enqueuePodsUsingClaim(newPVC.Namespace, newPVC.Name)
+		return
+	}
+	// the usage method and the capacity are taken from the pvc when its volumes are resolved
+	if !reflect.DeepEqual(oldPVC.Annotations, newPVC.Annotations) || !reflect.DeepEqual(oldPVC.Labels, newPVC.Labels) ||
+		!equalQuantity(claimCapacity(oldPVC), claimCapacity(newPVC)) {
+		klog.Infof("[ Update ] action: pvc [%s/%s] is updated, its volumes are resolved again", newPVC.Namespace, newPVC.Name)
+		for _, calculator := range c.calculators() {
+			if calculator.pod.Namespace == newPVC.Namespace {
+				calculator.provider.ResolveClaimAgain(newPVC.Name)
+			}
+		}
+		c.enqueuePodsUsingClaim(newPVC.Namespace, newPVC.Name)
+	}
+}
+
+func (c *VolumeController) addPV(obj interface{}) {
+	pv, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		return
+	}
+	if claimRef := pv.Spec.ClaimRef; claimRef != nil {
+		c.enqueuePodsUsingClaim(claimRef.Namespace, claimRef.Name)
+	}
+}
+
+func (c *VolumeController) updatePV(oldObj, newObj interface{}) {
+	oldPV, ok := oldObj.(*v1.PersistentVolume)
+	if !ok {
+		return
+	}
+	newPV, ok := newObj.(*v1.PersistentVolume)
+	if !ok {
+		return
+	}
+	if oldPV.ResourceVersion == newPV.ResourceVersion {
+		return
+	}
+	if claimRef := newPV.Spec.ClaimRef; claimRef != nil {
+		c.enqueuePodsUsingClaim(claimRef.Namespace, claimRef.Name)
+	}
+}
+
+// enqueuePodsUsingClaim requeues the pods on the node which use the pvc.
+func (c *VolumeController) enqueuePodsUsingClaim(namespace, claimName string) {
+	pods, err := c.podLister.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("list pods in namespace %s failed, err: %v", namespace, err)
+		return
+	}
+	for _, pod := range pods {
+		if !podUsesClaim(pod, claimName) {
+			continue
+		}
+		key, err := cache.MetaNamespaceKeyFunc(pod)
+		if err != nil {
+			klog.Error(err)
+			continue
+		}
+		c.markRetry(key)
+		c.queue.Add(key)
+	}
+}
+
+// podUsesClaim returns whether the pod uses the pvc, either directly or as a generic ephemeral volume.
+func podUsesClaim(pod *v1.Pod, claimName string) bool {
+	for _, vol := range pod.Spec.Volumes {
+		if claim := vol.VolumeSource.PersistentVolumeClaim; claim != nil && claim.ClaimName == claimName {
+			return true
+		}
+		if vol.VolumeSource == (v1.VolumeSource{}) && pod.Name+"-"+vol.Name == claimName {
+			return true
+		}
+	}
+	return false
+}
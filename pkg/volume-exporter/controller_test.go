@@ -0,0 +1,467 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	goruntime "runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformer "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	testNamespace  = "default"
+	testVolumeName = "data"
+)
+
+// testController is a VolumeController on a fake clientset, its informers are not started until run.
+type testController struct {
+	*VolumeController
+	client      *fake.Clientset
+	podInformer cache.SharedIndexInformer
+	pvcInformer cache.SharedIndexInformer
+	pvInformer  cache.SharedIndexInformer
+}
+
+func newTestController(t testing.TB, config VolumeControllerConfig, objects ...runtime.Object) *testController {
+	if config.MountInfoPath == "" {
+		config.MountInfoPath = filepath.Join(t.TempDir(), "mountinfo")
+		if err := ioutil.WriteFile(config.MountInfoPath, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := fake.NewSimpleClientset(objects...)
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	tc := &testController{
+		client:      client,
+		podInformer: coreinformer.NewPodInformer(client, metav1.NamespaceAll, 0, indexers),
+		pvcInformer: coreinformer.NewPersistentVolumeClaimInformer(client, metav1.NamespaceAll, 0, indexers),
+		pvInformer:  coreinformer.NewPersistentVolumeInformer(client, 0, cache.Indexers{}),
+	}
+	c, err := NewVolumeController(client, tc.podInformer, tc.pvcInformer, tc.pvInformer, config)
+	if err != nil {
+		t.Fatalf("NewVolumeController() error = %v", err)
+	}
+	tc.VolumeController = c
+
+	// the objects are visible to the listers without starting the informers
+	for _, obj := range objects {
+		var err error
+		switch obj.(type) {
+		case *v1.Pod:
+			err = tc.podInformer.GetIndexer().Add(obj)
+		case *v1.PersistentVolumeClaim:
+			err = tc.pvcInformer.GetIndexer().Add(obj)
+		case *v1.PersistentVolume:
+			err = tc.pvInformer.GetIndexer().Add(obj)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tc
+}
+
+// run starts the informers and the controller, it returns the function which stops them and waits
+// for the controller to return.
+func (tc *testController) run(t *testing.T) (shutdown func()) {
+	stop := make(chan struct{})
+	go tc.podInformer.Run(stop)
+	go tc.pvcInformer.Run(stop)
+	go tc.pvInformer.Run(stop)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := tc.Run(stop); err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	}()
+	return func() {
+		close(stop)
+		select {
+		case <-stopped:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("controller is not stopped in time")
+		}
+	}
+}
+
+// sync puts pod into the pod cache, or removes the pod named key if pod is nil, and syncs key as a
+// worker would.
+func (tc *testController) sync(t testing.TB, key string, pod *v1.Pod) {
+	indexer := tc.podInformer.GetIndexer()
+	if pod == nil {
+		if obj, ok, _ := indexer.GetByKey(key); ok {
+			if err := indexer.Delete(obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+	} else if err := indexer.Update(pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.syncHandler(key); err != nil {
+		t.Fatalf("syncHandler(%s) error = %v", key, err)
+	}
+}
+
+// volumeRefs returns the users of the shared volume id.
+func (tc *testController) volumeRefs(id string) []string {
+	tc.registry.lock.Lock()
+	defer tc.registry.lock.Unlock()
+	v, ok := tc.registry.volumes[id]
+	if !ok {
+		return nil
+	}
+	refs := make([]string, 0, len(v.refs))
+	for ref := range v.refs {
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+func newTestPod(name string, uid types.UID, claimName string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, UID: uid},
+		Spec: v1.PodSpec{
+			NodeName: "node-1",
+			Volumes: []v1.Volume{{
+				Name: testVolumeName,
+				VolumeSource: v1.VolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+				},
+			}},
+		},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+func newTestClaim(name, pvName string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: pvName},
+	}
+}
+
+// newTestHostPathPV returns a pv whose volume is the directory path, it is statted in place.
+func newTestHostPathPV(name, path string) *v1.PersistentVolume {
+	return newTestPV(name, v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: path}})
+}
+
+func TestAddPodRecreatedWithNewUID(t *testing.T) {
+	tc := newTestController(t, VolumeControllerConfig{},
+		newTestClaim("data-web-0", "pv-1"), newTestHostPathPV("pv-1", t.TempDir()))
+	key := testNamespace + "/web-0"
+
+	tc.sync(t, key, newTestPod("web-0", "uid-1", "data-web-0"))
+	old := tc.podToVolumes[key]
+	old.calcAndStoreStats()
+	if refs := tc.volumeRefs("pv/pv-1"); len(refs) != 1 || refs[0] != "uid-1/"+testVolumeName {
+		t.Fatalf("volume refs = %v, want the volume of uid-1", refs)
+	}
+
+	// the statefulset recreates the pod before the worker sees the deletion
+	tc.sync(t, key, newTestPod("web-0", "uid-2", "data-web-0"))
+	if uid, ok := tc.podUID(key); !ok || uid != "uid-2" {
+		t.Fatalf("podUID() = %q, %v, want uid-2", uid, ok)
+	}
+	if refs := tc.volumeRefs("pv/pv-1"); len(refs) != 0 {
+		t.Errorf("volume refs = %v after the pod is recreated, the old pod still uses the volume", refs)
+	}
+	// the old calculator is released and never brings back the stats of the old pod
+	old.calcAndStoreStats()
+	if entry := tc.store.Snapshot()[key]; entry == nil || entry.pod.UID != "uid-2" || len(entry.stats) != 0 {
+		t.Errorf("store entry = %+v, want the new pod without stats", entry)
+	}
+
+	tc.podToVolumes[key].calcAndStoreStats()
+	if refs := tc.volumeRefs("pv/pv-1"); len(refs) != 1 || refs[0] != "uid-2/"+testVolumeName {
+		t.Errorf("volume refs = %v, want the volume of uid-2", refs)
+	}
+	entry := tc.store.Snapshot()[key]
+	if len(entry.stats) != 1 || entry.stats[0].Status != okReason || entry.stats[0].CapacityBytes == nil {
+		t.Errorf("stats of the new pod = %+v, want the stats of the volume", entry.stats)
+	}
+}
+
+func TestDeletePodThenRecreate(t *testing.T) {
+	tc := newTestController(t, VolumeControllerConfig{},
+		newTestClaim("data-web-0", "pv-1"), newTestHostPathPV("pv-1", t.TempDir()))
+	key := testNamespace + "/web-0"
+
+	tc.sync(t, key, newTestPod("web-0", "uid-1", "data-web-0"))
+	tc.podToVolumes[key].calcAndStoreStats()
+
+	tc.sync(t, key, nil)
+	if tc.podExists(key) {
+		t.Fatalf("pod is still tracked after it is deleted")
+	}
+	if _, ok := tc.store.Snapshot()[key]; ok {
+		t.Errorf("stats of the deleted pod are still stored")
+	}
+	if refs := tc.volumeRefs("pv/pv-1"); len(refs) != 0 {
+		t.Errorf("volume refs = %v after the pod is deleted", refs)
+	}
+
+	// the deletion of a pod which is not tracked any more is ignored
+	tc.sync(t, key, nil)
+
+	tc.sync(t, key, newTestPod("web-0", "uid-2", "data-web-0"))
+	if uid, ok := tc.podUID(key); !ok || uid != "uid-2" {
+		t.Fatalf("podUID() = %q, %v, want uid-2", uid, ok)
+	}
+}
+
+func TestFastDeleteAndRecreateWithFakeClientset(t *testing.T) {
+	tc := newTestController(t, VolumeControllerConfig{CollectInterval: 20 * time.Millisecond},
+		newTestClaim("data-web-0", "pv-1"), newTestHostPathPV("pv-1", t.TempDir()))
+	shutdown := tc.run(t)
+	defer shutdown()
+
+	key := testNamespace + "/web-0"
+	pods := tc.client.CoreV1().Pods(testNamespace)
+	var uid types.UID
+	for i := 0; i < 10; i++ {
+		if i > 0 {
+			if err := pods.Delete("web-0", &metav1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		uid = types.UID(fmt.Sprintf("uid-%d", i))
+		if _, err := pods.Create(newTestPod("web-0", uid, "data-web-0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the pod ends up tracked with its latest uid, only which uses the volume
+	err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		if current, ok := tc.podUID(key); !ok || current != uid {
+			return false, nil
+		}
+		refs := tc.volumeRefs("pv/pv-1")
+		return len(refs) == 1 && refs[0] == string(uid)+"/"+testVolumeName, nil
+	})
+	if err != nil {
+		current, _ := tc.podUID(key)
+		t.Fatalf("pod is tracked with uid %q and volume refs %v, want %s", current, tc.volumeRefs("pv/pv-1"), uid)
+	}
+
+	err = wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		entry, ok := tc.store.Snapshot()[key]
+		return ok && entry.pod.UID == uid && len(entry.stats) == 1 && entry.stats[0].Status == okReason, nil
+	})
+	if err != nil {
+		t.Fatalf("stats of the latest pod are not stored, store entry: %+v", tc.store.Snapshot()[key])
+	}
+}
+
+func TestUpdatePVCResolvesVolumesAgain(t *testing.T) {
+	pvc := newTestClaim("data-web-0", "pv-1")
+	tc := newTestController(t, VolumeControllerConfig{}, pvc, newTestHostPathPV("pv-1", t.TempDir()))
+	key := testNamespace + "/web-0"
+
+	tc.sync(t, key, newTestPod("web-0", "uid-1", "data-web-0"))
+	provider := tc.podToVolumes[key].provider
+	tc.podToVolumes[key].calcAndStoreStats()
+	if method := provider.volumes[testVolumeName].provider.method; method != UsageMethodStatFS {
+		t.Fatalf("usage method = %q, want %q", method, UsageMethodStatFS)
+	}
+
+	// a resync changes nothing
+	tc.updatePVC(pvc, pvc)
+	if provider.volumes[testVolumeName].provider == nil {
+		t.Fatalf("volume is resolved again on a resync")
+	}
+
+	updated := pvc.DeepCopy()
+	updated.Annotations = map[string]string{UsageMethodAnnotation: UsageMethodDu}
+	if err := tc.pvcInformer.GetIndexer().Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	tc.updatePVC(pvc, updated)
+	if vol := provider.volumes[testVolumeName]; vol.provider != nil || vol.state != VolumePending {
+		t.Fatalf("volume is still resolved after its pvc is updated")
+	}
+	if refs := tc.volumeRefs("pv/pv-1"); len(refs) != 0 {
+		t.Errorf("volume refs = %v, the volume resolved from the old pvc is not released", refs)
+	}
+
+	tc.podToVolumes[key].calcAndStoreStats()
+	if vol := provider.volumes[testVolumeName]; vol.provider == nil || vol.provider.method != UsageMethodDu {
+		t.Errorf("volume is not resolved again with the usage method of the updated pvc")
+	}
+}
+
+func TestRunLeaksNoGoroutines(t *testing.T) {
+	baseline := goruntime.NumGoroutine()
+
+	pvc := newTestClaim("data-web-0", "pv-1")
+	pvc.Annotations = map[string]string{UsageMethodAnnotation: UsageMethodBoth}
+	tc := newTestController(t, VolumeControllerConfig{CollectInterval: 20 * time.Millisecond},
+		pvc, newTestHostPathPV("pv-1", t.TempDir()), newTestPod("web-0", "uid-1", "data-web-0"))
+	shutdown := tc.run(t)
+
+	key := testNamespace + "/web-0"
+	err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		entry, ok := tc.store.Snapshot()[key]
+		return ok && len(entry.stats) == 1 && entry.stats[0].DuStats != nil, nil
+	})
+	if err != nil {
+		t.Fatalf("du stats of the pod are not stored, store entry: %+v", tc.store.Snapshot()[key])
+	}
+	shutdown()
+
+	// the goroutines which are stopping may take a moment to return, wait.Poll is not used since its
+	// own goroutine would be counted
+	deadline := time.Now().Add(5 * time.Second)
+	for goruntime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if goruntime.NumGoroutine() > baseline {
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:goruntime.Stack(stacks, true)]
+		t.Errorf("%d goroutines are left after the controller is stopped, %d before it is created:\n%s",
+			goruntime.NumGoroutine(), baseline, stacks)
+	}
+}
+
+// TestResolveDoesNotBlockCollect resolves a volume whose stat hangs, as on a dead mount, and checks
+// that the workers and the scrapes go on meanwhile.
+func TestResolveDoesNotBlockCollect(t *testing.T) {
+	pvc := newTestClaim("data-web-0", "pv-1")
+	tc := newTestController(t, VolumeControllerConfig{}, pvc, newTestHostPathPV("pv-1", t.TempDir()))
+	key := testNamespace + "/web-0"
+	pod := newTestPod("web-0", "uid-1", "data-web-0")
+	tc.sync(t, key, pod)
+
+	provider := tc.podToVolumes[key].provider
+	resolve := provider.resolve
+	resolving, unblock := make(chan struct{}), make(chan struct{})
+	provider.resolve = func(pod *v1.Pod, vol v1.Volume) (*podVolumeMetricProvider, error) {
+		close(resolving)
+		<-unblock
+		return resolve(pod, vol)
+	}
+	calculated := make(chan struct{})
+	go func() {
+		defer close(calculated)
+		tc.podToVolumes[key].calcAndStoreStats()
+	}()
+	<-resolving
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := tc.syncHandler(key); err != nil {
+			t.Errorf("syncHandler(%s) error = %v", key, err)
+		}
+		ch := make(chan prometheus.Metric)
+		go func() {
+			defer close(ch)
+			NewVolumeStatsCollector(tc.VolumeController).Collect(ch)
+		}()
+		for range ch {
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the pod is not synced and collected while its volume is resolved")
+	}
+
+	// the pvc changes while the volume is resolved, the volume resolved from the old pvc is dropped
+	provider.ResolveClaimAgain(pvc.Name)
+	close(unblock)
+	<-calculated
+	provider.resolve = resolve
+	if vol := provider.volumes[testVolumeName]; vol.provider != nil || vol.err != MountPointNotReady {
+		t.Fatalf("volume = %+v, the volume resolved before its pvc changed is kept", vol)
+	}
+	if refs := tc.volumeRefs("pv/pv-1"); len(refs) != 0 {
+		t.Errorf("volume refs = %v, want none", refs)
+	}
+
+	tc.podToVolumes[key].calcAndStoreStats()
+	if vol := provider.volumes[testVolumeName]; vol.provider == nil {
+		t.Errorf("volume is not resolved again, err: %v", vol.err)
+	}
+}
+
+func TestResyncKeepsVolumeBackoff(t *testing.T) {
+	pvc := newTestClaim("data-web-0", "")
+	tc := newTestController(t, VolumeControllerConfig{}, pvc)
+	key := testNamespace + "/web-0"
+	pod := newTestPod("web-0", "uid-1", "data-web-0")
+	tc.sync(t, key, pod)
+
+	provider := tc.podToVolumes[key].provider
+	tc.podToVolumes[key].calcAndStoreStats()
+	retryAt := provider.volumes[testVolumeName].retryAt
+	if vol := provider.volumes[testVolumeName]; vol.err != PVCUnbound || retryAt.IsZero() {
+		t.Fatalf("volume err = %v, retry at %v, want it unbound and backing off", vol.err, retryAt)
+	}
+
+	// the updates and the resyncs of the pod do not retry the volume
+	updated := pod.DeepCopy()
+	updated.Labels = map[string]string{"app": "web"}
+	tc.sync(t, key, updated)
+	tc.sync(t, key, updated)
+	if got := provider.volumes[testVolumeName].retryAt; !got.Equal(retryAt) {
+		t.Errorf("retry at %v after a resync, want %v", got, retryAt)
+	}
+
+	// binding the pvc does
+	bound := newTestClaim("data-web-0", "pv-1")
+	if err := tc.pvcInformer.GetIndexer().Update(bound); err != nil {
+		t.Fatal(err)
+	}
+	tc.updatePVC(pvc, bound)
+	tc.sync(t, key, updated)
+	if got := provider.volumes[testVolumeName].retryAt; !got.IsZero() {
+		t.Errorf("retry at %v after the pvc is bound, want it retried now", got)
+	}
+	if tc.retryKeys.Len() != 0 {
+		t.Errorf("retry keys = %v, want none after the pod is synced", tc.retryKeys.List())
+	}
+}
+
+func TestIsPodInactive(t *testing.T) {
+	deleting := metav1.Now()
+	tests := []struct {
+		name     string
+		phase    v1.PodPhase
+		deleting bool
+		want     bool
+	}{
+		{name: "pending", phase: v1.PodPending, want: false},
+		{name: "running", phase: v1.PodRunning, want: false},
+		{name: "unknown", phase: v1.PodUnknown, want: false},
+		{name: "succeeded", phase: v1.PodSucceeded, want: true},
+		{name: "failed", phase: v1.PodFailed, want: true},
+		{name: "terminating", phase: v1.PodRunning, deleting: true, want: true},
+		{name: "terminating pending", phase: v1.PodPending, deleting: true, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := newTestPod("web-0", "uid-1", "data-web-0")
+			pod.Status.Phase = test.phase
+			if test.deleting {
+				pod.DeletionTimestamp = &deleting
+			}
+			if got := isPodInactive(pod); got != test.want {
+				t.Errorf("isPodInactive() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -2,10 +2,73 @@ package controller
 
 import (
 	"errors"
+	"syscall"
 )
 
 var (
-	PVCNotFound        = errors.New("PVCNotFound")        // the pvc that pod uses is not found
-	MountPointNotReady = errors.New("MountPointNotReady") // the mount point of pvc is not created on the host
+	PVCNotFound          = errors.New("PVCNotFound")          // the pvc that pod uses is not found
+	PVCUnbound           = errors.New("PVCUnbound")           // the pvc is not bound to any pv yet
+	PVNotFound           = errors.New("PVNotFound")           // the pv that pvc is bound to is not found
+	MountPointNotReady   = errors.New("MountPointNotReady")   // the mount point of pvc is not created on the host
+	NotMountPoint        = errors.New("NotMountPoint")        // the volume is no longer mounted at its mount point
+	StatTimeout          = errors.New("StatTimeout")          // the stat call on the volume does not return in time
+	StatWorkersExhausted = errors.New("StatWorkersExhausted") // every stat worker is taken by slow calls until the deadline
+	PermissionDenied     = errors.New("PermissionDenied")     // the exporter is not allowed to stat the volume
+	StaleHandle          = errors.New("StaleHandle")          // the network filesystem of the volume is gone on the server
+)
 
+const (
+	okReason           = "ok"
+	unknownErrorReason = "unknown"
 )
+
+// errorReasons are the reasons reported for the errors in the metrics.
+var errorReasons = map[error]string{
+	PVCNotFound:          "pvc_not_found",
+	PVCUnbound:           "pvc_unbound",
+	PVNotFound:           "pv_missing",
+	MountPointNotReady:   "mount_not_ready",
+	NotMountPoint:        "not_mountpoint",
+	StatTimeout:          "stat_timeout",
+	StatWorkersExhausted: "stat_timeout",
+	PermissionDenied:     "permission_denied",
+	StaleHandle:          "stale_handle",
+}
+
+// errorReason returns the reason reported for err in the metrics, it is ok for nil and unknown
+// for the errors which do not fall into any of the errors above.
+func errorReason(err error) string {
+	if err == nil {
+		return okReason
+	}
+	if reason, ok := errorReasons[err]; ok {
+		return reason
+	}
+	return unknownErrorReason
+}
+
+// isVolumePending returns whether err means the volume is not ready yet and may become ready later.
+func isVolumePending(err error) bool {
+	return err == PVCNotFound || err == PVCUnbound || err == PVNotFound || err == MountPointNotReady
+}
+
+// isStatTimeout returns whether err means the volume is not statted in time.
+func isStatTimeout(err error) bool {
+	return err == StatTimeout || err == StatWorkersExhausted
+}
+
+// classifyStatError converts the error of a stat call on a volume into PermissionDenied or StaleHandle
+// by the errno it wraps, other errors are returned as they are.
+func classifyStatError(err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	switch errno {
+	case syscall.EACCES, syscall.EPERM:
+		return PermissionDenied
+	case syscall.ESTALE:
+		return StaleHandle
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/volume"
+)
+
+func TestClassifyStatError(t *testing.T) {
+	other := errors.New("input/output error")
+	// the message of an error is not looked into
+	messageOnly := volume.NewFsInfoFailedError(syscall.ESTALE)
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "nil", err: nil, want: nil},
+		{name: "eacces", err: syscall.EACCES, want: PermissionDenied},
+		{name: "eperm", err: syscall.EPERM, want: PermissionDenied},
+		{name: "estale", err: syscall.ESTALE, want: StaleHandle},
+		{name: "statfs path error", err: &os.PathError{Op: "statfs", Path: "/mnt", Err: syscall.ESTALE}, want: StaleHandle},
+		{name: "open path error", err: &os.PathError{Op: "open", Path: "/dev/rbd0", Err: syscall.EPERM}, want: PermissionDenied},
+		{name: "wrapped", err: fmt.Errorf("stat volume: %w", &os.PathError{Op: "stat", Path: "/mnt", Err: syscall.EACCES}), want: PermissionDenied},
+		{name: "other errno", err: syscall.EIO, want: syscall.EIO},
+		{name: "other error", err: other, want: other},
+		{name: "errno in message only", err: messageOnly, want: messageOnly},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := classifyStatError(test.err); got != test.want {
+				t.Errorf("classifyStatError(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: "ok"},
+		{err: PVCNotFound, want: "pvc_not_found"},
+		{err: PVCUnbound, want: "pvc_unbound"},
+		{err: PVNotFound, want: "pv_missing"},
+		{err: MountPointNotReady, want: "mount_not_ready"},
+		{err: NotMountPoint, want: "not_mountpoint"},
+		{err: StatTimeout, want: "stat_timeout"},
+		{err: StatWorkersExhausted, want: "stat_timeout"},
+		{err: PermissionDenied, want: "permission_denied"},
+		{err: StaleHandle, want: "stale_handle"},
+		{err: errors.New("unsupported volume source"), want: "unknown"},
+	}
+	for _, test := range tests {
+		if got := errorReason(test.err); got != test.want {
+			t.Errorf("errorReason(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// workerStallTimeout is how long a worker may sync a single pod before it is considered wedged
+	workerStallTimeout = 5 * time.Minute
+	// collectStallIntervals is how many collect intervals may pass without a finished round before
+	// the collector is considered wedged
+	collectStallIntervals = 10
+)
+
+// healthCheck is a named check served by /healthz or /readyz.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// HealthzHandler serves the liveness of the exporter, it fails when the workers or the collector are wedged.
+func (c *VolumeController) HealthzHandler() http.Handler {
+	return newHealthHandler("healthz", []healthCheck{
+		{name: "ping", check: func() error { return nil }},
+		{name: "workers", check: c.checkWorkers},
+		{name: "collector", check: c.checkCollector},
+	})
+}
+
+// ReadyzHandler serves the readiness of the exporter, it is ready once the informer caches are synced
+// and the first collection round has finished.
+func (c *VolumeController) ReadyzHandler() http.Handler {
+	return newHealthHandler("readyz", []healthCheck{
+		{name: "ping", check: func() error { return nil }},
+		{name: "informer-sync", check: c.checkSynced},
+		{name: "first-collection", check: c.checkFirstCollection},
+	})
+}
+
+// checkWorkers fails if a pod has been synced for longer than workerStallTimeout.
+func (c *VolumeController) checkWorkers() error {
+	c.processingLock.Lock()
+	defer c.processingLock.Unlock()
+	for key, since := range c.processing {
+		if d := time.Since(since); d > workerStallTimeout {
+			return fmt.Errorf("pod %s has been synced for %v", key, d)
+		}
+	}
+	return nil
+}
+
+// checkCollector fails if no collection round has finished for collectStallIntervals. Nothing runs
+// between scrapes in on-scrape mode, so it is not checked then.
+func (c *VolumeController) checkCollector() error {
+	if c.scheduler.mode == CollectionModeOnScrape {
+		return nil
+	}
+	lastRound := c.scheduler.LastRound()
+	if lastRound.IsZero() {
+		// the first round is checked by readyz
+		return nil
+	}
+	if d := time.Since(lastRound); d > collectStallIntervals*c.scheduler.interval {
+		return fmt.Errorf("no collection round has finished for %v", d)
+	}
+	return nil
+}
+
+// checkSynced fails until the informer caches are synced.
+func (c *VolumeController) checkSynced() error {
+	if atomic.LoadInt32(&c.synced) == 0 {
+		return fmt.Errorf("informer caches are not synced")
+	}
+	return nil
+}
+
+// checkFirstCollection fails until the first collection round has finished.
+func (c *VolumeController) checkFirstCollection() error {
+	if c.scheduler.LastRound().IsZero() {
+		return fmt.Errorf("the first collection round has not finished")
+	}
+	return nil
+}
+
+// newHealthHandler serves checks the same way as kube-apiserver. It responds "ok" when all the checks
+// pass, with ?verbose the result of every check is listed, and failed checks are listed with their
+// reasons withheld unless ?verbose is given.
+func newHealthHandler(name string, checks []healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, verbose := r.URL.Query()["verbose"]
+
+		var out bytes.Buffer
+		failed := false
+		for _, check := range checks {
+			err := check.check()
+			if err == nil {
+				fmt.Fprintf(&out, "[+]%s ok\n", check.name)
+				continue
+			}
+			failed = true
+			klog.Warningf("%s check %s failed, err: %v", name, check.name, err)
+			if verbose {
+				fmt.Fprintf(&out, "[-]%s failed: %v\n", check.name, err)
+			} else {
+				fmt.Fprintf(&out, "[-]%s failed: reason withheld\n", check.name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s%s check failed\n", out.String(), name)
+			return
+		}
+		if !verbose {
+			fmt.Fprint(w, "ok")
+			return
+		}
+		fmt.Fprintf(w, "%s%s check passed\n", out.String(), name)
+	}
+}
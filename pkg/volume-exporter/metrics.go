@@ -17,79 +17,301 @@ limitations under the License.
 package controller
 
 import (
+	"regexp"
+	"strconv"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 )
 
 const (
-	KubeletSubsystem             = "kubelet"
+	KubeletSubsystem = "kubelet"
+	// DefaultMetricPrefix keeps the pvc stats compatible with the kubelet_volume_stats_* metrics
+	DefaultMetricPrefix          = KubeletSubsystem
+	ExporterSubsystem            = "volume_exporter"
 	VolumeStatsCapacityBytesKey  = "volume_stats_capacity_bytes"
 	VolumeStatsAvailableBytesKey = "volume_stats_available_bytes"
 	VolumeStatsUsedBytesKey      = "volume_stats_used_bytes"
 	VolumeStatsInodesKey         = "volume_stats_inodes"
 	VolumeStatsInodesFreeKey     = "volume_stats_inodes_free"
 	VolumeStatsInodesUsedKey     = "volume_stats_inodes_used"
+
+	PodVolumeStatsCapacityBytesKey  = "pod_volume_stats_capacity_bytes"
+	PodVolumeStatsAvailableBytesKey = "pod_volume_stats_available_bytes"
+	PodVolumeStatsUsedBytesKey      = "pod_volume_stats_used_bytes"
+	PodVolumeStatsInodesKey         = "pod_volume_stats_inodes"
+	PodVolumeStatsInodesFreeKey     = "pod_volume_stats_inodes_free"
+	PodVolumeStatsInodesUsedKey     = "pod_volume_stats_inodes_used"
+
+	VolumeMountInfoKey  = "volume_mount_info"
+	VolumeNotMountedKey = "volume_not_mounted"
+
+	VolumeStaleKey            = "volume_stale"
+	VolumeStatTimeoutTotalKey = "volume_stat_timeout_total"
+
+	WatchedPodsKey = "watched_pods"
+
+	TrackedPodsKey           = "tracked_pods"
+	TrackedVolumesKey        = "tracked_volumes"
+	VolumeLastSuccessKey     = "volume_last_success_timestamp_seconds"
+	VolumeStatusKey          = "volume_status"
+	VolumeStatsLastUpdateKey = "volume_stats_last_update_timestamp_seconds"
+
+	PVCLabelsKey      = "persistentvolumeclaim_labels"
+	PVCAnnotationsKey = "persistentvolumeclaim_annotations"
 )
 
 var (
-	volumeStatsCapacityBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("", KubeletSubsystem, VolumeStatsCapacityBytesKey),
-		"Capacity in bytes of the volume",
-		[]string{"namespace", "persistentvolumeclaim"}, nil,
-	)
-	volumeStatsAvailableBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("", KubeletSubsystem, VolumeStatsAvailableBytesKey),
-		"Number of available bytes in the volume",
-		[]string{"namespace", "persistentvolumeclaim"}, nil,
-	)
-	volumeStatsUsedBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("", KubeletSubsystem, VolumeStatsUsedBytesKey),
-		"Number of used bytes in the volume",
-		[]string{"namespace", "persistentvolumeclaim"}, nil,
-	)
-	volumeStatsInodesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("", KubeletSubsystem, VolumeStatsInodesKey),
-		"Maximum number of inodes in the volume",
-		[]string{"namespace", "persistentvolumeclaim"}, nil,
-	)
-	volumeStatsInodesFreeDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("", KubeletSubsystem, VolumeStatsInodesFreeKey),
-		"Number of free inodes in the volume",
-		[]string{"namespace", "persistentvolumeclaim"}, nil,
-	)
-	volumeStatsInodesUsedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("", KubeletSubsystem, VolumeStatsInodesUsedKey),
-		"Number of used inodes in the volume",
-		[]string{"namespace", "persistentvolumeclaim"}, nil,
+	volumeStatsLabels = []string{"namespace", "persistentvolumeclaim", "volume_mode", "method"}
+	// volumeStatsExtraLabels are the labels which can be added to the pvc stats, they are off by
+	// default to keep the cardinality down
+	volumeStatsExtraLabels = map[string]func(vs VolumeStats) string{
+		"storageclass":     func(vs VolumeStats) string { return vs.StorageClass },
+		"persistentvolume": func(vs VolumeStats) string { return vs.PVName },
+		"csi_driver":       func(vs VolumeStats) string { return vs.CSIDriver },
+		"volume_handle":    func(vs VolumeStats) string { return vs.VolumeHandle },
+		"access_modes":     func(vs VolumeStats) string { return vs.AccessModes },
+		"node":             func(vs VolumeStats) string { return vs.NodeName },
+		"pod":              func(vs VolumeStats) string { return vs.Name },
+	}
+	// ephemeral volumes have no stable pvc identity, so they are identified by the pod and volume name
+	podVolumeStatsLabels = []string{"namespace", "pod", "volume", "volume_type", "medium", "method"}
+
+	podVolumeStatsCapacityBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, PodVolumeStatsCapacityBytesKey),
+		"Capacity in bytes of the ephemeral volume",
+		podVolumeStatsLabels, nil,
+	)
+	podVolumeStatsAvailableBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, PodVolumeStatsAvailableBytesKey),
+		"Number of available bytes in the ephemeral volume",
+		podVolumeStatsLabels, nil,
+	)
+	podVolumeStatsUsedBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, PodVolumeStatsUsedBytesKey),
+		"Number of used bytes in the ephemeral volume",
+		podVolumeStatsLabels, nil,
+	)
+	podVolumeStatsInodesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, PodVolumeStatsInodesKey),
+		"Maximum number of inodes in the ephemeral volume",
+		podVolumeStatsLabels, nil,
+	)
+	podVolumeStatsInodesFreeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, PodVolumeStatsInodesFreeKey),
+		"Number of free inodes in the ephemeral volume",
+		podVolumeStatsLabels, nil,
+	)
+	podVolumeStatsInodesUsedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, PodVolumeStatsInodesUsedKey),
+		"Number of used inodes in the ephemeral volume",
+		podVolumeStatsLabels, nil,
+	)
+
+	volumeMountInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, VolumeMountInfoKey),
+		"Information about the mount of the volume, the value is always 1",
+		[]string{"namespace", "pod", "volume", "persistentvolumeclaim", "fstype", "device", "read_only"}, nil,
+	)
+	volumeNotMountedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, VolumeNotMountedKey),
+		"Whether the mountpoint of the volume is gone, stats of the volume are not reported while it is 1",
+		[]string{"namespace", "pod", "volume", "persistentvolumeclaim"}, nil,
+	)
+	volumeStaleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, VolumeStaleKey),
+		"Whether the stat calls on the volume timed out too many times in a row",
+		[]string{"namespace", "pod", "volume", "persistentvolumeclaim"}, nil,
+	)
+	volumeStatTimeoutTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, VolumeStatTimeoutTotalKey),
+		"Number of stat calls on the volume that timed out",
+		[]string{"namespace", "pod", "volume", "persistentvolumeclaim"}, nil,
+	)
+
+	trackedPodsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, TrackedPodsKey),
+		"Number of pods whose volumes are collected",
+		nil, nil,
+	)
+	trackedVolumesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, TrackedVolumesKey),
+		"Number of volumes of the tracked pods by state, which is pending, ready, failed or stale",
+		[]string{"state"}, nil,
+	)
+	volumeLastSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, VolumeLastSuccessKey),
+		"Unix time when the stats of the volume were collected successfully the last time",
+		[]string{"namespace", "pod", "volume", "persistentvolumeclaim"}, nil,
+	)
+	volumeStatusDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, VolumeStatusKey),
+		"Why the stats of the volume are missing, the value is always 1. The reason is ok when they are reported, "+
+			"otherwise one of pvc_not_found, pvc_unbound, pv_missing, mount_not_ready, not_mountpoint, stat_timeout, "+
+			"permission_denied, stale_handle or unknown",
+		[]string{"namespace", "persistentvolumeclaim", "pod", "volume", "reason"}, nil,
+	)
+	volumeStatsLastUpdateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, VolumeStatsLastUpdateKey),
+		"Unix time when the reported stats of the volume were measured",
+		[]string{"namespace", "pod", "volume", "persistentvolumeclaim"}, nil,
+	)
+	watchedPodsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", ExporterSubsystem, WatchedPodsKey),
+		"Number of pods on the node watched by the exporter, 0 usually means the node name is wrong",
+		nil, nil,
 	)
 )
 
+// volumeStatsDescs describe the pvc stats, their labels depend on the extra labels enabled.
+type volumeStatsDescs struct {
+	capacityBytes  *prometheus.Desc
+	availableBytes *prometheus.Desc
+	usedBytes      *prometheus.Desc
+	inodes         *prometheus.Desc
+	inodesFree     *prometheus.Desc
+	inodesUsed     *prometheus.Desc
+}
+
+// newVolumeStatsDescs creates the descs of the pvc stats named <prefix>_volume_stats_*.
+func newVolumeStatsDescs(prefix string, extraLabels []string) volumeStatsDescs {
+	labelNames := append(append([]string{}, volumeStatsLabels...), extraLabels...)
+	newDesc := func(key, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("", prefix, key), help, labelNames, nil)
+	}
+	return volumeStatsDescs{
+		capacityBytes:  newDesc(VolumeStatsCapacityBytesKey, "Capacity in bytes of the volume"),
+		availableBytes: newDesc(VolumeStatsAvailableBytesKey, "Number of available bytes in the volume"),
+		usedBytes:      newDesc(VolumeStatsUsedBytesKey, "Number of used bytes in the volume"),
+		inodes:         newDesc(VolumeStatsInodesKey, "Maximum number of inodes in the volume"),
+		inodesFree:     newDesc(VolumeStatsInodesFreeKey, "Number of free inodes in the volume"),
+		inodesUsed:     newDesc(VolumeStatsInodesUsedKey, "Number of used inodes in the volume"),
+	}
+}
+
+var metricPrefixRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// isValidMetricPrefix returns whether prefix makes valid metric names.
+func isValidMetricPrefix(prefix string) bool {
+	return metricPrefixRE.MatchString(prefix)
+}
+
+// isValidExtraLabel returns whether label can be added to the pvc stats.
+func isValidExtraLabel(label string) bool {
+	_, ok := volumeStatsExtraLabels[label]
+	return ok
+}
+
 type volumeStatsCollector struct {
-	c *VolumeController
+	c           *VolumeController
+	extraLabels []string
+	// volumeStats has the descs of the legacy kubelet names as well while migrating to a new prefix
+	volumeStats []volumeStatsDescs
+
+	// pvcLabelsDesc and pvcAnnotationsDesc are nil if no pvc label or annotation is allowed
+	pvcLabelsDesc      *prometheus.Desc
+	pvcAnnotationsDesc *prometheus.Desc
 }
 
 // NewVolumeStatsCollector creates a volume stats prometheus collector.
 func NewVolumeStatsCollector(c *VolumeController) prometheus.Collector {
-	return &volumeStatsCollector{c: c}
+	collector := &volumeStatsCollector{
+		c:           c,
+		extraLabels: c.extraLabels,
+	}
+
+	// the keys are validated by the controller already
+	labelNames, _ := pvcMetadataLabelNames(pvcLabelPrefix, c.pvcLabels)
+	annotationNames, _ := pvcMetadataLabelNames(pvcAnnotationPrefix, c.pvcAnnotations)
+	if len(labelNames) > 0 {
+		collector.pvcLabelsDesc = prometheus.NewDesc(
+			prometheus.BuildFQName("", ExporterSubsystem, PVCLabelsKey),
+			"Kubernetes labels of the persistent volume claim converted to prometheus labels, the value is always 1",
+			append([]string{"namespace", "persistentvolumeclaim"}, labelNames...), nil,
+		)
+	}
+	if len(annotationNames) > 0 {
+		collector.pvcAnnotationsDesc = prometheus.NewDesc(
+			prometheus.BuildFQName("", ExporterSubsystem, PVCAnnotationsKey),
+			"Kubernetes annotations of the persistent volume claim converted to prometheus labels, the value is always 1",
+			append([]string{"namespace", "persistentvolumeclaim"}, annotationNames...), nil,
+		)
+	}
+
+	statsLabels := c.extraLabels
+	if c.pvcLabelsOnStats {
+		statsLabels = append(append([]string{}, c.extraLabels...), labelNames...)
+	}
+	collector.volumeStats = []volumeStatsDescs{newVolumeStatsDescs(c.metricPrefix, statsLabels)}
+	if c.legacyMetrics && c.metricPrefix != KubeletSubsystem {
+		collector.volumeStats = append(collector.volumeStats, newVolumeStatsDescs(KubeletSubsystem, statsLabels))
+	}
+	return collector
 }
 
 // Describe implements the prometheus.Collector interface.
 func (collector *volumeStatsCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- volumeStatsCapacityBytesDesc
-	ch <- volumeStatsAvailableBytesDesc
-	ch <- volumeStatsUsedBytesDesc
-	ch <- volumeStatsInodesDesc
-	ch <- volumeStatsInodesFreeDesc
-	ch <- volumeStatsInodesUsedDesc
+	for _, descs := range collector.volumeStats {
+		ch <- descs.capacityBytes
+		ch <- descs.availableBytes
+		ch <- descs.usedBytes
+		ch <- descs.inodes
+		ch <- descs.inodesFree
+		ch <- descs.inodesUsed
+	}
+	ch <- podVolumeStatsCapacityBytesDesc
+	ch <- podVolumeStatsAvailableBytesDesc
+	ch <- podVolumeStatsUsedBytesDesc
+	ch <- podVolumeStatsInodesDesc
+	ch <- podVolumeStatsInodesFreeDesc
+	ch <- podVolumeStatsInodesUsedDesc
+	ch <- volumeMountInfoDesc
+	ch <- volumeNotMountedDesc
+	ch <- volumeStaleDesc
+	ch <- volumeStatTimeoutTotalDesc
+	ch <- watchedPodsDesc
+	ch <- trackedPodsDesc
+	ch <- trackedVolumesDesc
+	ch <- volumeLastSuccessDesc
+	ch <- volumeStatusDesc
+	ch <- volumeStatsLastUpdateDesc
+	if collector.pvcLabelsDesc != nil {
+		ch <- collector.pvcLabelsDesc
+	}
+	if collector.pvcAnnotationsDesc != nil {
+		ch <- collector.pvcAnnotationsDesc
+	}
 }
 
 // Collect implements the prometheus.Collector interface.
 func (collector *volumeStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	collector.c.scheduler.Refresh()
 
-	addGauge := func(desc *prometheus.Desc, pvcname, namespace string, v float64, lv ...string) {
-		lv = append([]string{namespace, pvcname}, lv...)
-		metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, v, lv...)
+	// addSample adds a gauge measured at ts, ts is attached to the sample if sample timestamps are enabled
+	addSample := func(desc *prometheus.Desc, v *uint64, ts time.Time, lv ...string) {
+		if v == nil {
+			// the value is not reported for this kind of volume, e.g. inodes of a block volume
+			return
+		}
+		metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, float64(*v), lv...)
+		if err != nil {
+			klog.Warningf("Failed to generate metric: %v", err)
+			return
+		}
+		if collector.c.sampleTimestamps && !ts.IsZero() {
+			metric = prometheus.NewMetricWithTimestamp(ts, metric)
+		}
+		ch <- metric
+	}
+	addGauge := func(desc *prometheus.Desc, v *uint64, lv ...string) {
+		addSample(desc, v, time.Time{}, lv...)
+	}
+	addCounter := func(desc *prometheus.Desc, v uint64, lv ...string) {
+		metric, err := prometheus.NewConstMetric(desc, prometheus.CounterValue, float64(v), lv...)
 		if err != nil {
 			klog.Warningf("Failed to generate metric: %v", err)
 			return
@@ -97,23 +319,144 @@ func (collector *volumeStatsCollector) Collect(ch chan<- prometheus.Metric) {
 		ch <- metric
 	}
 
+	if pods, err := collector.c.podLister.List(labels.Everything()); err == nil {
+		watchedPods := uint64(len(pods))
+		addGauge(watchedPodsDesc, &watchedPods)
+	}
+
+	calculators := collector.c.calculators()
+	trackedPods := uint64(len(calculators))
+	addGauge(trackedPodsDesc, &trackedPods)
+	states := map[volumeState]int{VolumePending: 0, VolumeReady: 0, VolumeFailed: 0, VolumeStale: 0}
+	for _, calculator := range calculators {
+		calculator.provider.CountStates(states)
+	}
+	for state, count := range states {
+		n := uint64(count)
+		addGauge(trackedVolumesDesc, &n, string(state))
+	}
+
 	allPVCs := sets.String{}
-	for _, vc := range collector.c.podToVolumes {
-		volumeStats, _ := vc.GetLatest()
-		for _, vs := range volumeStats {
+	addPVCStats := func(vs VolumeStats, stats FsStats, method string) {
+		pvcUniqStr := vs.Namespace + "/" + vs.PVCName + "/" + method
+		if allPVCs.Has(pvcUniqStr) {
+			// ignore if already collected
+			return
+		}
+		lv := []string{vs.Namespace, vs.PVCName, string(vs.VolumeMode), method}
+		for _, label := range collector.extraLabels {
+			lv = append(lv, volumeStatsExtraLabels[label](vs))
+		}
+		if collector.c.pvcLabelsOnStats {
+			var pvcLabels map[string]string
+			if pvc, err := collector.c.pvcLister.PersistentVolumeClaims(vs.Namespace).Get(vs.PVCName); err == nil {
+				pvcLabels = pvc.Labels
+			}
+			lv = append(lv, pvcMetadataValues(pvcLabels, collector.c.pvcLabels)...)
+		}
+		ts := stats.Time.Time
+		for _, descs := range collector.volumeStats {
+			addSample(descs.capacityBytes, stats.CapacityBytes, ts, lv...)
+			addSample(descs.availableBytes, stats.AvailableBytes, ts, lv...)
+			addSample(descs.usedBytes, stats.UsedBytes, ts, lv...)
+			addSample(descs.inodes, stats.Inodes, ts, lv...)
+			addSample(descs.inodesFree, stats.InodesFree, ts, lv...)
+			addSample(descs.inodesUsed, stats.InodesUsed, ts, lv...)
+		}
+		allPVCs.Insert(pvcUniqStr)
+	}
+	addPodVolumeStats := func(vs VolumeStats, stats FsStats, method string) {
+		lv := []string{vs.Namespace, vs.Name, vs.VolumeName, vs.VolumeType, string(vs.Medium), method}
+		ts := stats.Time.Time
+		addSample(podVolumeStatsCapacityBytesDesc, stats.CapacityBytes, ts, lv...)
+		addSample(podVolumeStatsAvailableBytesDesc, stats.AvailableBytes, ts, lv...)
+		addSample(podVolumeStatsUsedBytesDesc, stats.UsedBytes, ts, lv...)
+		addSample(podVolumeStatsInodesDesc, stats.Inodes, ts, lv...)
+		addSample(podVolumeStatsInodesFreeDesc, stats.InodesFree, ts, lv...)
+		addSample(podVolumeStatsInodesUsedDesc, stats.InodesUsed, ts, lv...)
+	}
+
+	snapshot := collector.c.store.Snapshot()
+	authoritative := authoritativePods(snapshot)
+	for key, entry := range snapshot {
+		for _, vs := range entry.stats {
+			one := uint64(1)
+			addGauge(volumeStatusDesc, &one, vs.Namespace, vs.PVCName, vs.Name, vs.VolumeName, vs.Status)
+			if vs.Unresolved {
+				continue
+			}
+
+			lv := []string{vs.Namespace, vs.Name, vs.VolumeName, vs.PVCName}
+			if vs.FsType != "" {
+				notMounted := uint64(0)
+				if vs.NotMounted {
+					notMounted = 1
+				}
+				addGauge(volumeMountInfoDesc, &one, vs.Namespace, vs.Name, vs.VolumeName, vs.PVCName, vs.FsType, vs.Device, strconv.FormatBool(vs.ReadOnly))
+				addGauge(volumeNotMountedDesc, &notMounted, lv...)
+			}
+			stale := uint64(0)
+			if vs.Stale {
+				stale = 1
+			}
+			addGauge(volumeStaleDesc, &stale, lv...)
+			addCounter(volumeStatTimeoutTotalDesc, vs.StatTimeouts, lv...)
+			if !vs.LastSuccess.IsZero() {
+				lastSuccess := uint64(vs.LastSuccess.Unix())
+				addGauge(volumeLastSuccessDesc, &lastSuccess, lv...)
+			}
+			if lastUpdate := vs.lastUpdate(); !lastUpdate.IsZero() {
+				lastUpdateSeconds := uint64(lastUpdate.Unix())
+				addGauge(volumeStatsLastUpdateDesc, &lastUpdateSeconds, lv...)
+			}
 
-			pvcUniqStr := vs.Namespace + "/" + vs.PVCName
-			if allPVCs.Has(pvcUniqStr) {
-				// ignore if already collected
+			addStats := addPVCStats
+			if vs.VolumeType != volumeTypePVC {
+				addStats = addPodVolumeStats
+			} else if authoritative[vs.Namespace+"/"+vs.PVCName] != key {
+				// another pod on the node reports the pvc
 				continue
 			}
-			addGauge(volumeStatsCapacityBytesDesc, vs.PVCName, vs.Namespace, float64(*vs.CapacityBytes))
-			addGauge(volumeStatsAvailableBytesDesc, vs.PVCName, vs.Namespace, float64(*vs.AvailableBytes))
-			addGauge(volumeStatsUsedBytesDesc, vs.PVCName, vs.Namespace, float64(*vs.UsedBytes))
-			addGauge(volumeStatsInodesDesc, vs.PVCName, vs.Namespace, float64(*vs.Inodes))
-			addGauge(volumeStatsInodesFreeDesc, vs.PVCName, vs.Namespace, float64(*vs.InodesFree))
-			addGauge(volumeStatsInodesUsedDesc, vs.PVCName, vs.Namespace, float64(*vs.InodesUsed))
-			allPVCs.Insert(pvcUniqStr)
+			if vs.CapacityBytes != nil && collector.isFresh(vs.FsStats.Time.Time, 0) {
+				method := UsageMethodStatFS
+				if vs.Method == "" {
+					// block volumes have no usage method
+					method = ""
+				}
+				addStats(vs, vs.FsStats, method)
+			}
+			if vs.DuStats != nil && collector.isFresh(vs.DuStats.Time.Time, collector.c.du.interval) {
+				addStats(vs, *vs.DuStats, UsageMethodDu)
+			}
 		}
 	}
+
+	if collector.pvcLabelsDesc != nil || collector.pvcAnnotationsDesc != nil {
+		one := uint64(1)
+		for pvcKey := range authoritative {
+			namespace, name, err := cache.SplitMetaNamespaceKey(pvcKey)
+			if err != nil {
+				continue
+			}
+			pvc, err := collector.c.pvcLister.PersistentVolumeClaims(namespace).Get(name)
+			if err != nil {
+				continue
+			}
+			if collector.pvcLabelsDesc != nil {
+				lv := append([]string{namespace, name}, pvcMetadataValues(pvc.Labels, collector.c.pvcLabels)...)
+				addGauge(collector.pvcLabelsDesc, &one, lv...)
+			}
+			if collector.pvcAnnotationsDesc != nil {
+				lv := append([]string{namespace, name}, pvcMetadataValues(pvc.Annotations, collector.c.pvcAnnotations)...)
+				addGauge(collector.pvcAnnotationsDesc, &one, lv...)
+			}
+		}
+	}
+}
+
+// isFresh returns whether stats measured at ts are still reported. They are dropped once they are
+// older than the max stats age plus period, the interval at which they are expected to be refreshed.
+func (collector *volumeStatsCollector) isFresh(ts time.Time, period time.Duration) bool {
+	maxAge := collector.c.maxStatsAge
+	return maxAge <= 0 || time.Since(ts) <= maxAge+period
 }
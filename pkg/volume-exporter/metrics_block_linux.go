@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/volume"
+)
+
+// sysfs reports the size of every block device of the host in 512-byte sectors, it is readable
+// by unprivileged containers. They are variables for tests.
+var (
+	// sysDevBlockDir holds the block devices by their major:minor numbers
+	sysDevBlockDir = "/sys/dev/block"
+	// sysClassBlockDir holds the block devices by their kernel names
+	sysClassBlockDir = "/sys/class/block"
+)
+
+const sectorSize = 512
+
+var _ volume.MetricsProvider = &metricsBlock{}
+
+// metricsBlock represents a MetricsProvider that reports the size of a raw block device.
+type metricsBlock struct {
+	// the path of the block device the volume is published to.
+	path string
+}
+
+// newMetricsBlock creates a new metricsBlock with the device path.
+func newMetricsBlock(path string) volume.MetricsProvider {
+	return &metricsBlock{path}
+}
+
+// GetMetrics gets the size of the block device from sysfs. Only Capacity is set, a raw block device
+// has no filesystem to report used bytes or inodes from. The device is never opened, so the exporter
+// needs no access to the devices of the host.
+func (mb *metricsBlock) GetMetrics() (*volume.Metrics, error) {
+	metrics := &volume.Metrics{Time: metav1.Now()}
+	if mb.path == "" {
+		return metrics, volume.NewNoPathDefinedError()
+	}
+
+	sizePath, err := blockDeviceSizePath(mb.path)
+	if err != nil {
+		return metrics, err
+	}
+	data, err := ioutil.ReadFile(sizePath)
+	if err != nil {
+		return metrics, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return metrics, fmt.Errorf("failed to parse the size of block device %s in %s, err: %v", mb.path, sizePath, err)
+	}
+	metrics.Capacity = resource.NewQuantity(sectors*sectorSize, resource.BinarySI)
+
+	return metrics, nil
+}
+
+// blockDeviceSizePath returns the sysfs file holding the size of the block device at path. The
+// device is found by the major:minor numbers of its node, or by its name if the node of the host
+// is not visible in the exporter, e.g. /dev/rbd0.
+func blockDeviceSizePath(path string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		if err == unix.ENOENT {
+			return filepath.Join(sysClassBlockDir, filepath.Base(path), "size"), nil
+		}
+		return "", &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", path)
+	}
+	rdev := uint64(stat.Rdev)
+	return filepath.Join(sysDevBlockDir, fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev)), "size"), nil
+}
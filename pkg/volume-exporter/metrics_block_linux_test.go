@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeSysBlock points the sysfs block directories to a temporary directory for the test.
+func fakeSysBlock(t *testing.T) (devDir, classDir string) {
+	sys := t.TempDir()
+	devDir, classDir = filepath.Join(sys, "dev", "block"), filepath.Join(sys, "class", "block")
+	oldDev, oldClass := sysDevBlockDir, sysClassBlockDir
+	sysDevBlockDir, sysClassBlockDir = devDir, classDir
+	t.Cleanup(func() { sysDevBlockDir, sysClassBlockDir = oldDev, oldClass })
+	return devDir, classDir
+}
+
+func writeSectors(t *testing.T, dir, sectors string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "size"), []byte(sectors+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsBlockByDeviceNumber(t *testing.T) {
+	// any block device node will do, it is only statted
+	var device string
+	entries, _ := ioutil.ReadDir("/dev")
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeDevice != 0 && entry.Mode()&os.ModeCharDevice == 0 {
+			device = filepath.Join("/dev", entry.Name())
+			break
+		}
+	}
+	if device == "" {
+		t.Skip("no block device node is found under /dev")
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(device, &stat); err != nil {
+		t.Fatal(err)
+	}
+
+	devDir, _ := fakeSysBlock(t)
+	rdev := uint64(stat.Rdev)
+	writeSectors(t, filepath.Join(devDir, fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev))), "2048")
+
+	metrics, err := newMetricsBlock(device).GetMetrics()
+	if err != nil {
+		t.Fatalf("GetMetrics() error = %v", err)
+	}
+	if metrics.Capacity == nil || metrics.Capacity.Value() != 2048*512 {
+		t.Errorf("capacity = %v, want %d", metrics.Capacity, 2048*512)
+	}
+	if metrics.Used != nil || metrics.InodesUsed != nil {
+		t.Errorf("usage of a raw block device is reported")
+	}
+}
+
+func TestMetricsBlockByName(t *testing.T) {
+	_, classDir := fakeSysBlock(t)
+	writeSectors(t, filepath.Join(classDir, "rbd0"), "4096")
+
+	// the device nodes of the host are not mounted into the exporter
+	metrics, err := newMetricsBlock(filepath.Join(t.TempDir(), "dev", "rbd0")).GetMetrics()
+	if err != nil {
+		t.Fatalf("GetMetrics() error = %v", err)
+	}
+	if metrics.Capacity == nil || metrics.Capacity.Value() != 4096*512 {
+		t.Errorf("capacity = %v, want %d", metrics.Capacity, 4096*512)
+	}
+}
+
+func TestMetricsBlockNotBlockDevice(t *testing.T) {
+	fakeSysBlock(t)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newMetricsBlock(path).GetMetrics(); err == nil {
+		t.Errorf("GetMetrics() on a regular file succeeded")
+	}
+}
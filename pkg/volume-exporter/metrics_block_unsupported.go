@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package controller
+
+import (
+	"k8s.io/kubernetes/pkg/volume"
+)
+
+// newMetricsBlock returns a MetricsProvider that does not support block devices on this platform.
+func newMetricsBlock(path string) volume.MetricsProvider {
+	return &volume.MetricsNil{}
+}
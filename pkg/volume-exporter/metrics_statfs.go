@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"os"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/volume"
+	"k8s.io/kubernetes/pkg/volume/util/fs"
+)
+
+var _ volume.MetricsProvider = &metricsStatFS{}
+
+// metricsStatFS reports the usage of the filesystem the volume is on like volume.MetricsStatFS, but
+// keeps the error of statfs, whose errno tells why the volume can not be statted.
+type metricsStatFS struct {
+	// the directory path the volume is mounted to.
+	path string
+}
+
+// newMetricsStatFS creates a new metricsStatFS with the volume path.
+func newMetricsStatFS(path string) volume.MetricsProvider {
+	return &metricsStatFS{path}
+}
+
+// GetMetrics gets the capacity, usage and inodes of the filesystem with statfs.
+func (md *metricsStatFS) GetMetrics() (*volume.Metrics, error) {
+	metrics := &volume.Metrics{Time: metav1.Now()}
+	if md.path == "" {
+		return metrics, volume.NewNoPathDefinedError()
+	}
+
+	available, capacity, usage, inodes, inodesFree, inodesUsed, err := fs.FsInfo(md.path)
+	if err != nil {
+		return metrics, &os.PathError{Op: "statfs", Path: md.path, Err: err}
+	}
+	metrics.Available = resource.NewQuantity(available, resource.BinarySI)
+	metrics.Capacity = resource.NewQuantity(capacity, resource.BinarySI)
+	metrics.Used = resource.NewQuantity(usage, resource.BinarySI)
+	metrics.Inodes = resource.NewQuantity(inodes, resource.BinarySI)
+	metrics.InodesFree = resource.NewQuantity(inodesFree, resource.BinarySI)
+	metrics.InodesUsed = resource.NewQuantity(inodesUsed, resource.BinarySI)
+	return metrics, nil
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TestConcurrentAddDeleteAndCollect adds and deletes pods while they are collected and scraped, as the
+// workers, the collection rounds and the scrapes do. It is meant to be run with -race.
+func TestConcurrentAddDeleteAndCollect(t *testing.T) {
+	const (
+		pods   = 8
+		rounds = 50
+	)
+	var objects []runtime.Object
+	for i := 0; i < pods; i++ {
+		objects = append(objects,
+			newTestClaim(fmt.Sprintf("data-web-%d", i), fmt.Sprintf("pv-%d", i)),
+			newTestHostPathPV(fmt.Sprintf("pv-%d", i), t.TempDir()))
+	}
+	tc := newTestController(t, VolumeControllerConfig{
+		CollectionMode:     CollectionModeOnScrape,
+		CacheTTL:           time.Millisecond,
+		PVCLabelsAllowlist: []string{"app"},
+		PVCLabelsOnStats:   true,
+	}, objects...)
+	collector := NewVolumeStatsCollector(tc.VolumeController)
+	stop := make(chan struct{})
+
+	var scrapers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		scrapers.Add(1)
+		go func() {
+			defer scrapers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ch := make(chan prometheus.Metric)
+				go func() {
+					defer close(ch)
+					collector.Collect(ch)
+				}()
+				for range ch {
+				}
+			}
+		}()
+	}
+
+	// the work queue never syncs a key in two workers at once, so every worker owns its pod here
+	var workers sync.WaitGroup
+	for i := 0; i < pods; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			name := fmt.Sprintf("web-%d", i)
+			key := testNamespace + "/" + name
+			indexer := tc.podInformer.GetIndexer()
+			for j := 0; j < rounds; j++ {
+				pod := newTestPod(name, types.UID(fmt.Sprintf("uid-%d-%d", i, j)), "data-"+name)
+				if err := indexer.Update(pod); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := tc.syncHandler(key); err != nil {
+					t.Errorf("syncHandler(%s) error = %v", key, err)
+					return
+				}
+				// every other pod is deleted, the others are recreated with another uid
+				if j%2 == 1 {
+					if err := indexer.Delete(pod); err != nil {
+						t.Error(err)
+						return
+					}
+					if err := tc.syncHandler(key); err != nil {
+						t.Errorf("syncHandler(%s) error = %v", key, err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	workers.Wait()
+	close(stop)
+	scrapers.Wait()
+	tc.scheduler.Stop()
+
+	if n := len(tc.calculators()); n != 0 {
+		t.Errorf("%d pods are still tracked after all of them are deleted", n)
+	}
+	if n := len(tc.store.Snapshot()); n != 0 {
+		t.Errorf("stats of %d pods are left after all of them are deleted", n)
+	}
+	tc.registry.lock.Lock()
+	defer tc.registry.lock.Unlock()
+	if n := len(tc.registry.volumes); n != 0 {
+		t.Errorf("%d volumes are still registered after all the pods are deleted", n)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package controller
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// isLikelyMountPoint reports whether path is on a different device than its parent directory.
+// Bind mounts from the filesystem of the parent directory are not detected.
+func isLikelyMountPoint(path string) (bool, error) {
+	var stat, parentStat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(filepath.Dir(strings.TrimSuffix(path, "/")), &parentStat); err != nil {
+		return false, err
+	}
+	return stat.Dev != parentStat.Dev, nil
+}
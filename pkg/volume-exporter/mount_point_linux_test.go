@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/api/core/v1"
+)
+
+// TestResolveVolumeNotInMountInfo resolves a pv which is mounted at the path kubelet mounts it at, but
+// is missing from the mountinfo file. It mounts a tmpfs, which needs root.
+func TestResolveVolumeNotInMountInfo(t *testing.T) {
+	host := t.TempDir()
+	tc := newTestController(t, VolumeControllerConfig{HostPrefix: host},
+		newTestClaim("data-web-0", "pv-1"), newTestPV("pv-1", v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{}}))
+	pod := newTestPod("web-0", "uid-1", "data-web-0")
+	path := filepath.Join(host, DefaultKubeletRootDir, "pods/uid-1/volumes/kubernetes.io~nfs/pv-1")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tc.newPodVolumeMetricProvider(pod, pod.Spec.Volumes[0]); err != MountPointNotReady {
+		t.Fatalf("newPodVolumeMetricProvider() error = %v before the volume is mounted, want %v", err, MountPointNotReady)
+	}
+
+	if err := unix.Mount("tmpfs", path, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mount tmpfs at %s: %v", path, err)
+	}
+	t.Cleanup(func() { unix.Unmount(path, 0) })
+	provider, err := tc.newPodVolumeMetricProvider(pod, pod.Spec.Volumes[0])
+	if err != nil {
+		t.Fatalf("newPodVolumeMetricProvider() error = %v", err)
+	}
+	if provider.mount == nil || provider.mount.mountPoint != path {
+		t.Errorf("mount = %+v, want the mount at %s", provider.mount, path)
+	}
+	if _, err := provider.GetMetrics(); err != nil {
+		t.Errorf("GetMetrics() error = %v", err)
+	}
+}
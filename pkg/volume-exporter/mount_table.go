@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+const (
+	hostMountInfoPath = "/proc/1/mountinfo"
+	selfMountInfoPath = "/proc/self/mountinfo"
+)
+
+// mountInfo is a mount of a pod volume parsed from the mountinfo file.
+type mountInfo struct {
+	// the path where the volume is mounted, as seen by the exporter
+	mountPoint string
+	// major:minor of the mounted filesystem
+	majorMinor string
+	fsType     string
+	// the mount source, e.g. /dev/sdb or 10.0.0.1:/export
+	source   string
+	options  []string
+	readOnly bool
+}
+
+// podVolumeKey identifies a volume mounted for a pod. The volume name is the name of the pv for
+// persistent volumes and the name in pod spec for the others.
+type podVolumeKey struct {
+	podUID     types.UID
+	volumeName string
+}
+
+// mountTable maps the volumes of pods to their real mountpoints on the node.
+type mountTable struct {
+	mountInfoPath string
+	resolver      *volumePathResolver
+
+	lock   sync.RWMutex
+	mounts map[podVolumeKey]*mountInfo
+}
+
+// newMountTable creates a mountTable from mountInfoPath. If mountInfoPath is empty, the mountinfo of
+// the host PID namespace is used when it is visible, otherwise that of the exporter itself.
+func newMountTable(mountInfoPath string, resolver *volumePathResolver) *mountTable {
+	if mountInfoPath == "" {
+		mountInfoPath = selfMountInfoPath
+		if _, err := os.Stat(hostMountInfoPath); err == nil {
+			mountInfoPath = hostMountInfoPath
+		}
+	}
+	return &mountTable{
+		mountInfoPath: mountInfoPath,
+		resolver:      resolver,
+		mounts:        make(map[podVolumeKey]*mountInfo),
+	}
+}
+
+// Lookup returns the mount of the volume of pod. The mountinfo file is read again when the volume is
+// not known yet, so volumes mounted after the last refresh are found as well.
+func (t *mountTable) Lookup(podUID types.UID, volumeName string) (*mountInfo, bool) {
+	key := podVolumeKey{podUID: podUID, volumeName: volumeName}
+
+	t.lock.RLock()
+	mount, ok := t.mounts[key]
+	t.lock.RUnlock()
+	if ok {
+		return mount, true
+	}
+
+	if err := t.Refresh(); err != nil {
+		klog.Errorf("refresh mount table from %s failed, err: %v", t.mountInfoPath, err)
+		return nil, false
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	mount, ok = t.mounts[key]
+	return mount, ok
+}
+
+// IsMountPoint checks that path is still a mountpoint. The device of path is compared with its parent
+// first, the mountinfo file is read again for bind mounts which share the device of their parent.
+func (t *mountTable) IsMountPoint(path string) (bool, error) {
+	mounted, err := isLikelyMountPoint(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if mounted {
+		return true, nil
+	}
+
+	if err := t.Refresh(); err != nil {
+		return false, err
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, mount := range t.mounts {
+		if mount.mountPoint == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Refresh reads the mountinfo file and replaces all the known mounts.
+func (t *mountTable) Refresh() error {
+	f, err := os.Open(t.mountInfoPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mounts := make(map[podVolumeKey]*mountInfo)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		mount, err := parseMountInfoLine(scanner.Text())
+		if err != nil {
+			return err
+		}
+		if key, ok := t.podVolumeKey(mount); ok {
+			mounts[key] = mount
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.mounts = mounts
+	return nil
+}
+
+// podVolumeKey finds the pod volume that mount belongs to. Volumes are mounted by kubelet at
+// <root-dir>/pods/<uid>/volumes/<plugin>/<volume>, csi volumes have an extra "mount" directory.
+// The mountpoint is rewritten to the path seen by the exporter.
+func (t *mountTable) podVolumeKey(mount *mountInfo) (podVolumeKey, bool) {
+	podsDir := filepath.Join(t.resolver.kubeletRootDir, "pods") + "/"
+	containerPodsDir := t.resolver.hostPath(podsDir) + "/"
+
+	var rel string
+	switch {
+	case strings.HasPrefix(mount.mountPoint, containerPodsDir):
+		rel = strings.TrimPrefix(mount.mountPoint, containerPodsDir)
+	case strings.HasPrefix(mount.mountPoint, podsDir):
+		// read from the host mount namespace
+		rel = strings.TrimPrefix(mount.mountPoint, podsDir)
+		mount.mountPoint = t.resolver.hostPath(mount.mountPoint)
+	default:
+		return podVolumeKey{}, false
+	}
+
+	parts := strings.Split(rel, "/")
+	if len(parts) < 4 || parts[1] != "volumes" {
+		return podVolumeKey{}, false
+	}
+	if len(parts) > 5 || (len(parts) == 5 && parts[4] != "mount") {
+		// subpath and other nested mounts inside the volume
+		return podVolumeKey{}, false
+	}
+	return podVolumeKey{podUID: types.UID(parts[0]), volumeName: parts[3]}, true
+}
+
+// parseMountInfoLine parses a line of mountinfo, see proc(5):
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfoLine(line string) (*mountInfo, error) {
+	fields := strings.Fields(line)
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(fields) < sep+3 {
+		return nil, fmt.Errorf("malformed mountinfo line: %q", line)
+	}
+
+	mount := &mountInfo{
+		mountPoint: unescapeMountInfo(fields[4]),
+		majorMinor: fields[2],
+		fsType:     fields[sep+1],
+		source:     unescapeMountInfo(fields[sep+2]),
+		options:    strings.Split(fields[5], ","),
+	}
+	if len(fields) > sep+3 {
+		mount.options = append(mount.options, strings.Split(fields[sep+3], ",")...)
+	}
+	for _, opt := range strings.Split(fields[5], ",") {
+		if opt == "ro" {
+			mount.readOnly = true
+		}
+	}
+	return mount, nil
+}
+
+// unescapeMountInfo decodes the octal escapes, like \040 for space, used in mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
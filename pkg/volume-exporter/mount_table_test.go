@@ -0,0 +1,257 @@
+package controller
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestParseMountInfoLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *mountInfo
+		wantErr bool
+	}{
+		{
+			name: "no optional fields",
+			line: "36 35 98:0 /mnt1 /mnt2 rw,noatime - ext3 /dev/root rw,errors=continue",
+			want: &mountInfo{
+				mountPoint: "/mnt2",
+				majorMinor: "98:0",
+				fsType:     "ext3",
+				source:     "/dev/root",
+				options:    []string{"rw", "noatime", "rw", "errors=continue"},
+			},
+		},
+		{
+			name: "optional fields",
+			line: "36 35 98:0 /mnt1 /mnt2 rw,noatime shared:1 master:2 - ext3 /dev/root rw",
+			want: &mountInfo{
+				mountPoint: "/mnt2",
+				majorMinor: "98:0",
+				fsType:     "ext3",
+				source:     "/dev/root",
+				options:    []string{"rw", "noatime", "rw"},
+			},
+		},
+		{
+			name: "no super options",
+			line: "36 35 0:52 / /mnt/nfs rw - nfs4 10.0.0.1:/export",
+			want: &mountInfo{
+				mountPoint: "/mnt/nfs",
+				majorMinor: "0:52",
+				fsType:     "nfs4",
+				source:     "10.0.0.1:/export",
+				options:    []string{"rw"},
+			},
+		},
+		{
+			name: "escaped spaces",
+			line: `36 35 0:52 / /mnt/my\040volume rw - nfs4 10.0.0.1:/my\040export rw`,
+			want: &mountInfo{
+				mountPoint: "/mnt/my volume",
+				majorMinor: "0:52",
+				fsType:     "nfs4",
+				source:     "10.0.0.1:/my export",
+				options:    []string{"rw", "rw"},
+			},
+		},
+		{
+			name: "read only mount",
+			line: "36 35 8:16 / /mnt/ro ro,relatime shared:5 - xfs /dev/sdb rw,attr2",
+			want: &mountInfo{
+				mountPoint: "/mnt/ro",
+				majorMinor: "8:16",
+				fsType:     "xfs",
+				source:     "/dev/sdb",
+				options:    []string{"ro", "relatime", "rw", "attr2"},
+				readOnly:   true,
+			},
+		},
+		{
+			// only the options of the mount make it read only, not those of the filesystem
+			name: "read only filesystem",
+			line: "36 35 8:16 / /mnt/rw rw,relatime - xfs /dev/sdb ro",
+			want: &mountInfo{
+				mountPoint: "/mnt/rw",
+				majorMinor: "8:16",
+				fsType:     "xfs",
+				source:     "/dev/sdb",
+				options:    []string{"rw", "relatime", "ro"},
+			},
+		},
+		{name: "empty", line: "", wantErr: true},
+		{name: "no separator", line: "36 35 98:0 /mnt1 /mnt2 rw,noatime ext3 /dev/root rw", wantErr: true},
+		{name: "no source", line: "36 35 98:0 /mnt1 /mnt2 rw,noatime - ext3", wantErr: true},
+		{name: "separator too early", line: "36 35 98:0 /mnt1 - ext3 /dev/root rw", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseMountInfoLine(test.line)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseMountInfoLine() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseMountInfoLine() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/mnt/data", want: "/mnt/data"},
+		{in: `/mnt/my\040volume`, want: "/mnt/my volume"},
+		{in: `/mnt/tab\011and\012newline`, want: "/mnt/tab\tand\nnewline"},
+		{in: `/mnt/back\134slash`, want: `/mnt/back\slash`},
+		{in: `/mnt/end\040`, want: "/mnt/end "},
+		// not an escape, kept as it is
+		{in: `/mnt/short\04`, want: `/mnt/short\04`},
+		{in: `/mnt/not\999octal`, want: `/mnt/not\999octal`},
+		{in: `/mnt/trailing\`, want: `/mnt/trailing\`},
+	}
+	for _, test := range tests {
+		if got := unescapeMountInfo(test.in); got != test.want {
+			t.Errorf("unescapeMountInfo(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestPodVolumeKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		kubeletRootDir string
+		hostPrefix     string
+		mountPoint     string
+		want           podVolumeKey
+		wantOK         bool
+		wantMountPoint string
+	}{
+		{
+			name:           "host namespace",
+			mountPoint:     "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~nfs/pv-1",
+			want:           podVolumeKey{podUID: "uid-1", volumeName: "pv-1"},
+			wantOK:         true,
+			wantMountPoint: "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~nfs/pv-1",
+		},
+		{
+			name:           "csi",
+			mountPoint:     "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pv-1/mount",
+			want:           podVolumeKey{podUID: "uid-1", volumeName: "pv-1"},
+			wantOK:         true,
+			wantMountPoint: "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pv-1/mount",
+		},
+		{
+			name:           "custom kubelet root dir",
+			kubeletRootDir: "/data/kubelet",
+			mountPoint:     "/data/kubelet/pods/uid-1/volumes/kubernetes.io~empty-dir/cache",
+			want:           podVolumeKey{podUID: "uid-1", volumeName: "cache"},
+			wantOK:         true,
+			wantMountPoint: "/data/kubelet/pods/uid-1/volumes/kubernetes.io~empty-dir/cache",
+		},
+		{
+			// the mountinfo of the host pid namespace has the paths of the host
+			name:           "host prefix, host mountpoint",
+			hostPrefix:     "/host",
+			mountPoint:     "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~rbd/pv-1",
+			want:           podVolumeKey{podUID: "uid-1", volumeName: "pv-1"},
+			wantOK:         true,
+			wantMountPoint: "/host/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~rbd/pv-1",
+		},
+		{
+			// the mountinfo of the exporter has the paths under the host prefix
+			name:           "host prefix, container mountpoint",
+			hostPrefix:     "/host",
+			mountPoint:     "/host/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pv-1/mount",
+			want:           podVolumeKey{podUID: "uid-1", volumeName: "pv-1"},
+			wantOK:         true,
+			wantMountPoint: "/host/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pv-1/mount",
+		},
+		{
+			name:           "subpath",
+			mountPoint:     "/var/lib/kubelet/pods/uid-1/volume-subpaths/pv-1/app/0",
+			wantMountPoint: "/var/lib/kubelet/pods/uid-1/volume-subpaths/pv-1/app/0",
+		},
+		{
+			name:           "nested mount",
+			mountPoint:     "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~nfs/pv-1/data",
+			wantMountPoint: "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~nfs/pv-1/data",
+		},
+		{
+			name:           "nested mount in csi volume",
+			mountPoint:     "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pv-1/mount/data",
+			wantMountPoint: "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pv-1/mount/data",
+		},
+		{
+			name:           "plugin directory",
+			mountPoint:     "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~nfs",
+			wantMountPoint: "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~nfs",
+		},
+		{
+			name:           "csi global mount",
+			mountPoint:     "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount",
+			wantMountPoint: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount",
+		},
+		{
+			name:           "outside kubelet",
+			mountPoint:     "/mnt/data",
+			wantMountPoint: "/mnt/data",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := newMountTable("", newVolumePathResolver(test.kubeletRootDir, test.hostPrefix))
+			mount := &mountInfo{mountPoint: test.mountPoint}
+			got, ok := table.podVolumeKey(mount)
+			if ok != test.wantOK || got != test.want {
+				t.Errorf("podVolumeKey() = %+v, %v, want %+v, %v", got, ok, test.want, test.wantOK)
+			}
+			if mount.mountPoint != test.wantMountPoint {
+				t.Errorf("mountpoint = %q, want %q", mount.mountPoint, test.wantMountPoint)
+			}
+		})
+	}
+}
+
+func TestMountTableRefresh(t *testing.T) {
+	lines := "" +
+		"1 0 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n" +
+		"2 1 0:52 / /var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~nfs/pv-1 rw shared:3 - nfs4 10.0.0.1:/export rw\n" +
+		"3 2 0:52 /app /var/lib/kubelet/pods/uid-1/volume-subpaths/pv-1/app/0 rw - nfs4 10.0.0.1:/export rw\n" +
+		`4 1 8:16 / /var/lib/kubelet/pods/uid-2/volumes/kubernetes.io~csi/pv-2/mount ro - xfs /dev/sdb rw` + "\n"
+	path := writeTestMountInfo(t, lines)
+
+	table := newMountTable(path, newVolumePathResolver("", ""))
+	if err := table.Refresh(); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if len(table.mounts) != 2 {
+		t.Errorf("mounts = %v, want the volumes of uid-1 and uid-2 only", table.mounts)
+	}
+	if mount, ok := table.Lookup("uid-1", "pv-1"); !ok || mount.source != "10.0.0.1:/export" || mount.readOnly {
+		t.Errorf("Lookup(uid-1, pv-1) = %+v, %v", mount, ok)
+	}
+	if mount, ok := table.Lookup(types.UID("uid-2"), "pv-2"); !ok || mount.fsType != "xfs" || !mount.readOnly {
+		t.Errorf("Lookup(uid-2, pv-2) = %+v, %v", mount, ok)
+	}
+
+	if err := newMountTable(writeTestMountInfo(t, "malformed\n"), newVolumePathResolver("", "")).Refresh(); err == nil {
+		t.Errorf("Refresh() of a malformed mountinfo succeeds")
+	}
+}
+
+// writeTestMountInfo writes a mountinfo file with lines and returns its path.
+func writeTestMountInfo(t *testing.T, lines string) string {
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	if err := ioutil.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"fmt"
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	pvcLabelPrefix      = "label_"
+	pvcAnnotationPrefix = "annotation_"
+)
+
+var invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// sanitizeLabelName converts a kubernetes label or annotation key into a prometheus label name,
+// e.g. "app.kubernetes.io/team" becomes "app_kubernetes_io_team".
+func sanitizeLabelName(key string) string {
+	return invalidLabelCharRE.ReplaceAllString(key, "_")
+}
+
+// pvcMetadataLabelNames returns the prometheus label names of the allowed pvc label or annotation
+// keys. Keys which end up with the same name are rejected, their values could not be told apart.
+func pvcMetadataLabelNames(prefix string, keys []string) ([]string, error) {
+	names := make([]string, 0, len(keys))
+	seen := sets.NewString()
+	for _, key := range keys {
+		name := prefix + sanitizeLabelName(key)
+		if seen.Has(name) {
+			return nil, fmt.Errorf("key %q is a duplicate of another key after it is converted to label %s", key, name)
+		}
+		seen.Insert(name)
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// pvcMetadataValues returns the values of keys in metadata, the missing keys have empty values so
+// every series of a metric has the same labels.
+func pvcMetadataValues(metadata map[string]string, keys []string) []string {
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, metadata[key])
+	}
+	return values
+}
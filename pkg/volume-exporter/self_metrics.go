@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	StatDurationSecondsKey   = "stat_duration_seconds"
+	CollectionErrorsTotalKey = "collection_errors_total"
+	CalculatorGoroutinesKey  = "calculator_goroutines"
+	WorkqueueSubsystem       = "workqueue"
+)
+
+// the metrics of the exporter itself, they tell why the stats of volumes are missing
+var (
+	statDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ExporterSubsystem,
+		Name:      StatDurationSecondsKey,
+		Help:      "Latency of the stat calls on volumes, the calls which time out are observed at the timeout",
+		// 1ms to 16s, which covers the default stat timeout
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	collectionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ExporterSubsystem,
+		Name:      CollectionErrorsTotalKey,
+		Help:      "Number of failures to resolve or stat a volume by reason",
+	}, []string{"reason"})
+	calculatorGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ExporterSubsystem,
+		Name:      CalculatorGoroutinesKey,
+		Help:      "Number of goroutines calculating the stats of pods at the moment",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(statDuration, collectionErrors, calculatorGoroutines)
+	// the provider must be set before the queue of the controller is created
+	workqueue.SetProvider(workqueueMetricsProvider{})
+}
+
+// observeStat records the latency of a stat call started at start.
+func observeStat(start time.Time) {
+	statDuration.Observe(time.Since(start).Seconds())
+}
+
+// recordCollectionError counts a failure to resolve or stat a volume.
+func recordCollectionError(reason string) {
+	collectionErrors.WithLabelValues(reason).Inc()
+}
+
+// workqueueMetricsProvider exposes the metrics of the work queues as
+// volume_exporter_workqueue_*{name="<queue>"}.
+type workqueueMetricsProvider struct{}
+
+// register registers c, or returns the collector already registered with the same metrics.
+func (workqueueMetricsProvider) register(c prometheus.Collector) prometheus.Collector {
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+	}
+	return c
+}
+
+func (p workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return p.register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   ExporterSubsystem,
+		Subsystem:   WorkqueueSubsystem,
+		Name:        "depth",
+		Help:        "Current depth of the workqueue",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Gauge)
+}
+
+func (p workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return p.register(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   ExporterSubsystem,
+		Subsystem:   WorkqueueSubsystem,
+		Name:        "adds_total",
+		Help:        "Total number of adds handled by the workqueue",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Counter)
+}
+
+func (p workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.SummaryMetric {
+	return p.register(prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:   ExporterSubsystem,
+		Subsystem:   WorkqueueSubsystem,
+		Name:        "queue_latency_microseconds",
+		Help:        "How long an item stays in the workqueue before being requested",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Summary)
+}
+
+func (p workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return p.register(prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:   ExporterSubsystem,
+		Subsystem:   WorkqueueSubsystem,
+		Name:        "work_duration_microseconds",
+		Help:        "How long processing an item from the workqueue takes",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Summary)
+}
+
+func (p workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   ExporterSubsystem,
+		Subsystem:   WorkqueueSubsystem,
+		Name:        "unfinished_work_seconds",
+		Help:        "How many seconds of work are in progress and not observed by work_duration yet",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Gauge)
+}
+
+func (p workqueueMetricsProvider) NewLongestRunningProcessorMicrosecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   ExporterSubsystem,
+		Subsystem:   WorkqueueSubsystem,
+		Name:        "longest_running_processor_microseconds",
+		Help:        "How many microseconds the longest running processor of the workqueue has been running",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Gauge)
+}
+
+func (p workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return p.register(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   ExporterSubsystem,
+		Subsystem:   WorkqueueSubsystem,
+		Name:        "retries_total",
+		Help:        "Total number of retries handled by the workqueue",
+		ConstLabels: prometheus.Labels{"name": name},
+	})).(prometheus.Counter)
+}
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	DefaultStatTimeout = 10 * time.Second
+	DefaultStatWorkers = 8
+
+	// staleStatTimeouts is the number of consecutive timeouts after which a volume is stale
+	staleStatTimeouts = 3
+	// maxStatBackoff is the max delay before a volume that timed out is statted again
+	maxStatBackoff = 5 * time.Minute
+	// maxHungStats is the max number of hung calls which are given up on, each of them is a goroutine
+	// blocked in the kernel until the mount comes back
+	maxHungStats = 64
+)
+
+// statPool runs the stat calls on volumes with a bounded number of workers and a deadline per call.
+// A call on a dead network mount can hang forever in the kernel. The caller gives up waiting after
+// the deadline, and the hung call gives its worker back and is counted against the budget of hung
+// calls instead, so dead mounts do not starve the other volumes of workers.
+type statPool struct {
+	timeout time.Duration
+	workers chan struct{}
+	// hung holds a slot for every hung call that gave its worker back
+	hung chan struct{}
+}
+
+func newStatPool(timeout time.Duration, workers int) *statPool {
+	if timeout <= 0 {
+		timeout = DefaultStatTimeout
+	}
+	if workers <= 0 {
+		workers = DefaultStatWorkers
+	}
+	return &statPool{
+		timeout: timeout,
+		workers: make(chan struct{}, workers),
+		hung:    make(chan struct{}, maxHungStats),
+	}
+}
+
+// statState tracks the timeouts of the stat calls on a volume.
+type statState struct {
+	lock sync.Mutex
+	// hung is set while a call that timed out has not returned yet
+	hung bool
+	// timeouts is the number of consecutive timeouts
+	timeouts int
+	// totalTimeouts is the number of timeouts since the volume is tracked
+	totalTimeouts uint64
+	retryAt       time.Time
+}
+
+// Stale returns whether the volume timed out too many times in a row.
+func (s *statState) Stale() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.timeouts >= staleStatTimeouts
+}
+
+// TotalTimeouts returns the number of timeouts since the volume is tracked.
+func (s *statState) TotalTimeouts() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.totalTimeouts
+}
+
+// Run runs stat on a worker and waits for it until the deadline. StatTimeout is returned when the deadline
+// is exceeded, or when the volume is backing off from previous timeouts, in which case stat is not run.
+// An attempt skipped while an earlier call is still hung counts as a timeout, so a volume whose calls
+// never return becomes stale. StatWorkersExhausted is returned when no worker is available until the
+// deadline. stat must not be read from by the caller after either is returned.
+func (p *statPool) Run(state *statState, stat func() error) error {
+	now := time.Now()
+	state.lock.Lock()
+	if state.hung {
+		state.timeouts++
+		state.totalTimeouts++
+		state.lock.Unlock()
+		return StatTimeout
+	}
+	if now.Before(state.retryAt) {
+		state.lock.Unlock()
+		return StatTimeout
+	}
+	state.lock.Unlock()
+
+	deadline := time.NewTimer(p.timeout)
+	defer deadline.Stop()
+
+	select {
+	case p.workers <- struct{}{}:
+	case <-deadline.C:
+		// the volume backs off like a timed out one so the next rounds do not wait for a worker again,
+		// but it is not marked stale since it has not been statted at all
+		state.lock.Lock()
+		defer state.lock.Unlock()
+		state.retryAt = time.Now().Add(statBackoff(p.timeout, state.timeouts+1))
+		klog.Warningf("no stat worker is available in %v, %d calls are hung", p.timeout, len(p.hung))
+		return StatWorkersExhausted
+	}
+
+	// returned and detached are guarded by state.lock, detached is set when the call gave its
+	// worker back and holds a slot of the hung calls instead
+	returned, detached := false, false
+	done := make(chan error, 1)
+	go func() {
+		err := stat()
+
+		state.lock.Lock()
+		returned = true
+		state.hung = false
+		if detached {
+			<-p.hung
+		} else {
+			<-p.workers
+		}
+		state.lock.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		state.lock.Lock()
+		state.timeouts = 0
+		state.lock.Unlock()
+		return err
+	case <-deadline.C:
+		state.lock.Lock()
+		defer state.lock.Unlock()
+		state.hung = !returned
+		if state.hung {
+			select {
+			case p.hung <- struct{}{}:
+				detached = true
+				<-p.workers
+			default:
+				// too many calls are hung already, this one keeps its worker until it returns
+				klog.Warningf("%d stat calls are hung, no more workers are given back", len(p.hung))
+			}
+		}
+		state.timeouts++
+		state.totalTimeouts++
+		state.retryAt = time.Now().Add(statBackoff(p.timeout, state.timeouts))
+		return StatTimeout
+	}
+}
+
+// statBackoff doubles the delay with every consecutive timeout, up to maxStatBackoff.
+func statBackoff(timeout time.Duration, timeouts int) time.Duration {
+	backoff := timeout
+	for i := 1; i < timeouts && backoff < maxStatBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxStatBackoff {
+		backoff = maxStatBackoff
+	}
+	return backoff
+}
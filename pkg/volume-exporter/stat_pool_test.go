@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+const testStatTimeout = 50 * time.Millisecond
+
+// hangStat returns a stat call which blocks until release is closed, like statfs on a dead mount.
+func hangStat(release <-chan struct{}) func() error {
+	return func() error {
+		<-release
+		return nil
+	}
+}
+
+func TestStatPoolHungCallsGiveWorkersBack(t *testing.T) {
+	pool := newStatPool(testStatTimeout, 2)
+	release := make(chan struct{})
+	defer close(release)
+
+	for i := 0; i < 2; i++ {
+		if err := pool.Run(&statState{}, hangStat(release)); err != StatTimeout {
+			t.Fatalf("Run() on a hung volume = %v, want %v", err, StatTimeout)
+		}
+	}
+
+	start := time.Now()
+	if err := pool.Run(&statState{}, func() error { return nil }); err != nil {
+		t.Fatalf("Run() on a healthy volume = %v, want nil", err)
+	}
+	if d := time.Since(start); d >= testStatTimeout {
+		t.Errorf("Run() on a healthy volume waited %v for a worker", d)
+	}
+}
+
+func TestStatPoolSaturated(t *testing.T) {
+	pool := newStatPool(testStatTimeout, 2)
+	// no hung call may give its worker back
+	pool.hung = make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	for i := 0; i < 2; i++ {
+		if err := pool.Run(&statState{}, hangStat(release)); err != StatTimeout {
+			t.Fatalf("Run() on a hung volume = %v, want %v", err, StatTimeout)
+		}
+	}
+
+	state := &statState{}
+	called := false
+	if err := pool.Run(state, func() error { called = true; return nil }); err != StatWorkersExhausted {
+		t.Fatalf("Run() on a saturated pool = %v, want %v", err, StatWorkersExhausted)
+	}
+	if state.Stale() || state.TotalTimeouts() != 0 {
+		t.Errorf("a volume waiting for a worker is counted as timed out")
+	}
+	// the volume backs off instead of waiting for a worker again
+	start := time.Now()
+	if err := pool.Run(state, func() error { called = true; return nil }); err != StatTimeout {
+		t.Fatalf("Run() while backing off = %v, want %v", err, StatTimeout)
+	}
+	if d := time.Since(start); d >= testStatTimeout {
+		t.Errorf("Run() while backing off waited %v", d)
+	}
+	if called {
+		t.Errorf("stat is called without a worker")
+	}
+}
+
+func TestStatPoolStale(t *testing.T) {
+	pool := newStatPool(testStatTimeout, 1)
+	state := &statState{}
+
+	for i := 1; i <= staleStatTimeouts; i++ {
+		if state.Stale() {
+			t.Fatalf("volume is stale after %d timeouts", i-1)
+		}
+		release := make(chan struct{})
+		if err := pool.Run(state, hangStat(release)); err != StatTimeout {
+			t.Fatalf("Run() on a hung volume = %v, want %v", err, StatTimeout)
+		}
+		close(release)
+		// wait for the hung call to return and skip the backoff
+		for {
+			state.lock.Lock()
+			hung := state.hung
+			state.retryAt = time.Time{}
+			state.lock.Unlock()
+			if !hung {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if !state.Stale() || state.TotalTimeouts() != staleStatTimeouts {
+		t.Errorf("Stale() = %v, TotalTimeouts() = %d after %d timeouts", state.Stale(), state.TotalTimeouts(), staleStatTimeouts)
+	}
+
+	if err := pool.Run(state, func() error { return nil }); err != nil {
+		t.Fatalf("Run() on a recovered volume = %v, want nil", err)
+	}
+	if state.Stale() {
+		t.Errorf("volume is still stale after a successful stat")
+	}
+}
+
+func TestStatPoolNeverReturns(t *testing.T) {
+	pool := newStatPool(testStatTimeout, 1)
+	release := make(chan struct{})
+	defer close(release)
+	state := &statState{}
+
+	// like statfs on a dead hard mounted nfs, the first call never returns
+	if err := pool.Run(state, hangStat(release)); err != StatTimeout {
+		t.Fatalf("Run() on a hung volume = %v, want %v", err, StatTimeout)
+	}
+	for i := 2; i <= 10; i++ {
+		if err := pool.Run(state, func() error { return nil }); err != StatTimeout {
+			t.Fatalf("Run() on a volume with a hung call = %v, want %v", err, StatTimeout)
+		}
+		if got := state.TotalTimeouts(); got != uint64(i) {
+			t.Fatalf("TotalTimeouts() = %d after %d attempts", got, i)
+		}
+	}
+	if !state.Stale() {
+		t.Errorf("volume whose call never returns is not stale")
+	}
+}
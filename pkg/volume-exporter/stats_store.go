@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// podStats is the latest volume stats of a pod.
+type podStats struct {
+	pod   *v1.Pod
+	stats []VolumeStats
+}
+
+// statsStore holds the latest volume stats of all the pods on the node. It is shared by the
+// calculators which write to it and the prometheus collector which reads from it. Readers get an
+// immutable snapshot without locking, writers copy the map on every change, which is cheap for the
+// number of pods on a node.
+type statsStore struct {
+	// lock serializes the writers
+	lock    sync.Mutex
+	entries atomic.Value // map[string]*podStats
+}
+
+func newStatsStore() *statsStore {
+	s := &statsStore{}
+	s.entries.Store(map[string]*podStats{})
+	return s
+}
+
+// Snapshot returns the stats of all pods keyed by namespace/name. The returned map and the
+// stats in it must not be modified.
+func (s *statsStore) Snapshot() map[string]*podStats {
+	return s.entries.Load().(map[string]*podStats)
+}
+
+// Add starts to accept the stats of the pod for key.
+func (s *statsStore) Add(key string, pod *v1.Pod) {
+	s.update(func(entries map[string]*podStats) {
+		entries[key] = &podStats{pod: pod}
+	})
+}
+
+// SetPod updates the pod of the stats, e.g. when its phase changes.
+func (s *statsStore) SetPod(key string, pod *v1.Pod) {
+	s.update(func(entries map[string]*podStats) {
+		if entry, ok := entries[key]; ok && entry.pod.UID == pod.UID {
+			entries[key] = &podStats{pod: pod, stats: entry.stats}
+		}
+	})
+}
+
+// Update replaces the stats of the pod. It is ignored if the pod was deleted or recreated with another
+// uid meanwhile, so a calculator that is being stopped never brings back stale stats.
+func (s *statsStore) Update(key string, uid types.UID, stats []VolumeStats) {
+	s.update(func(entries map[string]*podStats) {
+		if entry, ok := entries[key]; ok && entry.pod.UID == uid {
+			entries[key] = &podStats{pod: entry.pod, stats: stats}
+		}
+	})
+}
+
+// Delete drops the stats of the pod.
+func (s *statsStore) Delete(key string) {
+	s.update(func(entries map[string]*podStats) {
+		delete(entries, key)
+	})
+}
+
+// update applies change to a copy of the entries and publishes the copy.
+func (s *statsStore) update(change func(entries map[string]*podStats)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.Snapshot()
+	entries := make(map[string]*podStats, len(old)+1)
+	for key, entry := range old {
+		entries[key] = entry
+	}
+	change(entries)
+	s.entries.Store(entries)
+}
+
+// authoritativePods chooses the pod whose stats are reported for every pvc used by several pods on
+// the node, keyed by namespace/pvc. Pods with stats are preferred, then running pods, then the newest.
+func authoritativePods(snapshot map[string]*podStats) map[string]string {
+	chosen := make(map[string]string)
+	for key, entry := range snapshot {
+		for _, vs := range entry.stats {
+			if vs.VolumeType != volumeTypePVC {
+				continue
+			}
+			pvcKey := vs.Namespace + "/" + vs.PVCName
+			if current, ok := chosen[pvcKey]; !ok || isMoreAuthoritative(key, entry, current, snapshot[current], vs.PVCName) {
+				chosen[pvcKey] = key
+			}
+		}
+	}
+	return chosen
+}
+
+// isMoreAuthoritative returns whether pod a should be reported for pvc rather than pod b.
+func isMoreAuthoritative(aKey string, a *podStats, bKey string, b *podStats, pvcName string) bool {
+	if aHas, bHas := hasPVCStats(a, pvcName), hasPVCStats(b, pvcName); aHas != bHas {
+		return aHas
+	}
+	if aRunning, bRunning := a.pod.Status.Phase == v1.PodRunning, b.pod.Status.Phase == v1.PodRunning; aRunning != bRunning {
+		return aRunning
+	}
+	if !a.pod.CreationTimestamp.Equal(&b.pod.CreationTimestamp) {
+		return b.pod.CreationTimestamp.Before(&a.pod.CreationTimestamp)
+	}
+	// keep the choice stable between scrapes
+	return aKey < bKey
+}
+
+// hasPVCStats returns whether the pod has any stats of pvc.
+func hasPVCStats(entry *podStats, pvcName string) bool {
+	for _, vs := range entry.stats {
+		if vs.VolumeType == volumeTypePVC && vs.PVCName == pvcName && (vs.CapacityBytes != nil || vs.DuStats != nil) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestStatsStoreUpdateAfterDelete(t *testing.T) {
+	store := newStatsStore()
+	key := testNamespace + "/web-0"
+
+	store.Add(key, newTestPod("web-0", "uid-1", "data-web-0"))
+	store.Delete(key)
+	store.Update(key, "uid-1", []VolumeStats{{Name: testVolumeName}})
+	if _, ok := store.Snapshot()[key]; ok {
+		t.Errorf("stats of a deleted pod are stored")
+	}
+
+	store.Add(key, newTestPod("web-0", "uid-2", "data-web-0"))
+	store.Update(key, "uid-1", []VolumeStats{{Name: testVolumeName}})
+	if entry := store.Snapshot()[key]; len(entry.stats) != 0 {
+		t.Errorf("stats of the old pod are stored for the recreated one")
+	}
+}
+
+// TestStatsStoreConcurrentAccess adds, updates and deletes pods while snapshots are read, it is meant
+// to be run with -race.
+func TestStatsStoreConcurrentAccess(t *testing.T) {
+	const (
+		pods   = 8
+		rounds = 200
+	)
+	store := newStatsStore()
+	stop := make(chan struct{})
+
+	var readers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				snapshot := store.Snapshot()
+				for _, entry := range snapshot {
+					for _, vs := range entry.stats {
+						_ = vs.Name
+					}
+				}
+				authoritativePods(snapshot)
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for i := 0; i < pods; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			name := fmt.Sprintf("web-%d", i)
+			key := testNamespace + "/" + name
+			for j := 0; j < rounds; j++ {
+				uid := types.UID(fmt.Sprintf("uid-%d-%d", i, j))
+				pod := newTestPod(name, uid, "data-"+name)
+				store.Add(key, pod)
+				store.Update(key, uid, []VolumeStats{{Name: testVolumeName, PVCName: "data-" + name}})
+				store.SetPod(key, pod)
+				store.Delete(key)
+			}
+		}(i)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	if snapshot := store.Snapshot(); len(snapshot) != 0 {
+		t.Errorf("%d pods are left in the store after all of them are deleted", len(snapshot))
+	}
+}
+
+// newTestPodStats returns the stats of a pod using the pvc data-web, created minutes after a fixed time.
+// The pvc has a capacity if withStats is set.
+func newTestPodStats(name string, phase v1.PodPhase, minutes int, withStats bool) *podStats {
+	pod := newTestPod(name, types.UID("uid-"+name), "data-web")
+	pod.Status.Phase = phase
+	pod.CreationTimestamp = metav1.NewTime(time.Date(2020, 1, 1, 0, minutes, 0, 0, time.UTC))
+	vs := VolumeStats{Name: testVolumeName, PVCName: "data-web", Namespace: testNamespace, VolumeType: volumeTypePVC}
+	if withStats {
+		capacity := uint64(1 << 30)
+		vs.CapacityBytes = &capacity
+	}
+	return &podStats{pod: pod, stats: []VolumeStats{vs}}
+}
+
+func TestIsMoreAuthoritative(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *podStats
+		want bool
+	}{
+		{
+			name: "with stats over without",
+			a:    newTestPodStats("a", v1.PodPending, 0, true),
+			b:    newTestPodStats("b", v1.PodRunning, 1, false),
+			want: true,
+		},
+		{
+			name: "without stats under with",
+			a:    newTestPodStats("a", v1.PodRunning, 1, false),
+			b:    newTestPodStats("b", v1.PodPending, 0, true),
+			want: false,
+		},
+		{
+			name: "running over succeeded",
+			a:    newTestPodStats("a", v1.PodRunning, 0, true),
+			b:    newTestPodStats("b", v1.PodSucceeded, 1, true),
+			want: true,
+		},
+		{
+			name: "failed under running",
+			a:    newTestPodStats("a", v1.PodFailed, 1, true),
+			b:    newTestPodStats("b", v1.PodRunning, 0, true),
+			want: false,
+		},
+		{
+			name: "newer over older",
+			a:    newTestPodStats("a", v1.PodRunning, 1, true),
+			b:    newTestPodStats("b", v1.PodRunning, 0, true),
+			want: true,
+		},
+		{
+			name: "older under newer",
+			a:    newTestPodStats("a", v1.PodRunning, 0, true),
+			b:    newTestPodStats("b", v1.PodRunning, 1, true),
+			want: false,
+		},
+		{
+			name: "tie broken by key",
+			a:    newTestPodStats("a", v1.PodRunning, 0, true),
+			b:    newTestPodStats("b", v1.PodRunning, 0, true),
+			want: true,
+		},
+		{
+			name: "tie broken by key, reversed",
+			a:    newTestPodStats("b", v1.PodRunning, 0, true),
+			b:    newTestPodStats("a", v1.PodRunning, 0, true),
+			want: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aKey, bKey := testNamespace+"/"+test.a.pod.Name, testNamespace+"/"+test.b.pod.Name
+			if got := isMoreAuthoritative(aKey, test.a, bKey, test.b, "data-web"); got != test.want {
+				t.Errorf("isMoreAuthoritative(%s, %s) = %v, want %v", aKey, bKey, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthoritativePods(t *testing.T) {
+	tests := []struct {
+		name string
+		pods []*podStats
+		want string
+	}{
+		{
+			name: "single pod",
+			pods: []*podStats{newTestPodStats("web-0", v1.PodRunning, 0, true)},
+			want: "web-0",
+		},
+		{
+			// the new pod of a rolling update is not mounted yet
+			name: "only the old pod has stats",
+			pods: []*podStats{
+				newTestPodStats("web-old", v1.PodRunning, 0, true),
+				newTestPodStats("web-new", v1.PodRunning, 5, false),
+			},
+			want: "web-old",
+		},
+		{
+			name: "completed job and running pod",
+			pods: []*podStats{
+				newTestPodStats("job", v1.PodSucceeded, 5, true),
+				newTestPodStats("failed", v1.PodFailed, 6, true),
+				newTestPodStats("web-0", v1.PodRunning, 0, true),
+			},
+			want: "web-0",
+		},
+		{
+			name: "newest running pod",
+			pods: []*podStats{
+				newTestPodStats("web-0", v1.PodRunning, 0, true),
+				newTestPodStats("web-1", v1.PodRunning, 2, true),
+				newTestPodStats("web-2", v1.PodRunning, 1, true),
+			},
+			want: "web-1",
+		},
+		{
+			name: "created at the same time",
+			pods: []*podStats{
+				newTestPodStats("web-2", v1.PodRunning, 0, true),
+				newTestPodStats("web-0", v1.PodRunning, 0, true),
+				newTestPodStats("web-1", v1.PodRunning, 0, true),
+			},
+			want: "web-0",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshot := make(map[string]*podStats)
+			for _, entry := range test.pods {
+				snapshot[testNamespace+"/"+entry.pod.Name] = entry
+			}
+			// the map is iterated in a random order, the choice must not depend on it
+			for i := 0; i < 20; i++ {
+				chosen := authoritativePods(snapshot)
+				if got, want := chosen[testNamespace+"/data-web"], testNamespace+"/"+test.want; got != want {
+					t.Fatalf("authoritative pod = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/volume"
+)
+
+const (
+	// UsageMethodStatFS reports the usage of the whole filesystem the volume is on
+	UsageMethodStatFS = "statfs"
+	// UsageMethodDu reports the usage of the volume directory by walking it, which is
+	// needed when many volumes are carved out of one shared filesystem
+	UsageMethodDu = "du"
+	// UsageMethodBoth reports the usage with both statfs and du
+	UsageMethodBoth = "both"
+
+	// UsageMethodAnnotation selects the usage method of a pvc, it overrides the method of the storage class
+	UsageMethodAnnotation = "volume-exporter.kpaas.io/usage-method"
+
+	DefaultDuInterval    = 5 * time.Minute
+	DefaultDuConcurrency = 2
+	DefaultDuTimeout     = 2 * time.Minute
+	// DefaultEmptyDirDuInterval is shorter than DefaultDuInterval since kubelet evicts the pods whose
+	// emptyDir exceeds its size limit, and the usage must be seen before that
+	DefaultEmptyDirDuInterval = 30 * time.Second
+)
+
+// getUsageMethod returns the usage method of pvc, which is chosen by the annotation of pvc or
+// by its storage class, statfs is used by default.
+func (c *VolumeController) getUsageMethod(pvc *v1.PersistentVolumeClaim) string {
+	if method, ok := pvc.Annotations[UsageMethodAnnotation]; ok {
+		if isValidUsageMethod(method) {
+			return method
+		}
+		klog.Warningf("pvc [%s/%s] has invalid usage method %q, valid methods are statfs, du and both", pvc.Namespace, pvc.Name, method)
+	}
+	if method, ok := c.storageClassUsageMethods[getStorageClassName(pvc)]; ok {
+		return method
+	}
+	return UsageMethodStatFS
+}
+
+func isValidUsageMethod(method string) bool {
+	return method == UsageMethodStatFS || method == UsageMethodDu || method == UsageMethodBoth
+}
+
+// getStorageClassName returns the storage class of pvc, the beta annotation is still honored.
+func getStorageClassName(pvc *v1.PersistentVolumeClaim) string {
+	if class, ok := pvc.Annotations[v1.BetaStorageClassAnnotation]; ok {
+		return class
+	}
+	if pvc.Spec.StorageClassName != nil {
+		return *pvc.Spec.StorageClassName
+	}
+	return ""
+}
+
+// claimCapacity returns the size of the volume of pvc, which is the capacity it is bound with or
+// the storage it requests. It is nil if neither is known.
+func claimCapacity(pvc *v1.PersistentVolumeClaim) *resource.Quantity {
+	if capacity, ok := pvc.Status.Capacity[v1.ResourceStorage]; ok {
+		return &capacity
+	}
+	if request, ok := pvc.Spec.Resources.Requests[v1.ResourceStorage]; ok {
+		return &request
+	}
+	return nil
+}
+
+// equalQuantity returns whether a and b are the same size, or both unknown.
+func equalQuantity(a, b *resource.Quantity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Cmp(*b) == 0
+}
+
+var _ volume.MetricsProvider = &metricsDu{}
+
+// metricsDu reports the bytes and inodes used by the volume directory with du and find. Unlike
+// volume.MetricsDu, the capacity of the filesystem the directory is on is not reported, since it is
+// shared with other volumes, e.g. the whole nfs export. The size of the volume is reported as its
+// capacity instead if it is known.
+type metricsDu struct {
+	path string
+	// capacity is the size of the volume, it is nil if the volume is not limited
+	capacity *resource.Quantity
+}
+
+func newMetricsDu(path string, capacity *resource.Quantity) *metricsDu {
+	return &metricsDu{path: path, capacity: capacity}
+}
+
+// GetMetrics runs du and find on the volume directory.
+func (md *metricsDu) GetMetrics() (*volume.Metrics, error) {
+	return md.getMetrics(context.Background())
+}
+
+// getMetrics runs du and find on the volume directory, they are killed once ctx is done.
+func (md *metricsDu) getMetrics(ctx context.Context) (*volume.Metrics, error) {
+	metrics := &volume.Metrics{Time: metav1.Now()}
+	if md.path == "" {
+		return metrics, volume.NewNoPathDefinedError()
+	}
+
+	used, err := diskUsage(ctx, md.path)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.Used = used
+	inodesUsed, err := countInodes(ctx, md.path)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.InodesUsed = resource.NewQuantity(inodesUsed, resource.BinarySI)
+
+	if md.capacity != nil {
+		available := md.capacity.Value() - used.Value()
+		if available < 0 {
+			available = 0
+		}
+		metrics.Capacity = resource.NewQuantity(md.capacity.Value(), resource.BinarySI)
+		metrics.Available = resource.NewQuantity(available, resource.BinarySI)
+	}
+	return metrics, nil
+}
+
+// diskUsage is fs.DiskUsage which is killed once ctx is done.
+func diskUsage(ctx context.Context, path string) (*resource.Quantity, error) {
+	// Uses the same niceness level as cadvisor.fs does when running du
+	// Uses -B 1 to always scale to a blocksize of 1 byte
+	out, err := exec.CommandContext(ctx, "nice", "-n", "19", "du", "-s", "-B", "1", path).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed command 'du' ($ nice -n 19 du -s -B 1) on path %s with error %v", path, err)
+	}
+	used, err := resource.ParseQuantity(strings.Fields(string(out))[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse 'du' output %s due to error %v", out, err)
+	}
+	used.Format = resource.BinarySI
+	return &used, nil
+}
+
+// countInodes is fs.Find which is killed once ctx is done, it counts the files and directories
+// under path like `find <path> -xdev -printf '.' | wc -c`.
+func countInodes(ctx context.Context, path string) (int64, error) {
+	var counter byteCounter
+	var stderr bytes.Buffer
+	findCmd := exec.CommandContext(ctx, "find", path, "-xdev", "-printf", ".")
+	findCmd.Stdout, findCmd.Stderr = &counter, &stderr
+	if err := findCmd.Run(); err != nil {
+		return 0, fmt.Errorf("cmd %v failed. stderr: %s; err: %v", findCmd.Args, stderr.String(), err)
+	}
+	return counter.bytesWritten, nil
+}
+
+// byteCounter is an io.Writer which counts how many bytes were written.
+type byteCounter struct{ bytesWritten int64 }
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	b.bytesWritten += int64(len(p))
+	return len(p), nil
+}
+
+// duScheduler runs du for volumes on a slower schedule than statfs, and limits how many du run at
+// the same time since walking a large volume is expensive. du runs through a pool of its own, so a
+// du hung on a dead mount is given up on after the deadline and the volume backs off like a hung stat.
+type duScheduler struct {
+	interval time.Duration
+	pool     *statPool
+
+	// ctx is cancelled by Stop, which kills the du running, every run is killed at its deadline as well
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	stopped bool
+	// runs tracks the du runs in the background
+	runs sync.WaitGroup
+}
+
+func newDuScheduler(interval time.Duration, concurrency int, timeout time.Duration) *duScheduler {
+	if interval <= 0 {
+		interval = DefaultDuInterval
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultDuConcurrency
+	}
+	if timeout <= 0 {
+		timeout = DefaultDuTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &duScheduler{
+		interval: interval,
+		pool:     newStatPool(timeout, concurrency),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Stop kills the du running and waits for their runs to return, no du is started afterwards.
+func (d *duScheduler) Stop() {
+	d.lock.Lock()
+	d.stopped = true
+	d.lock.Unlock()
+
+	d.cancel()
+	d.runs.Wait()
+}
+
+// start runs f in the background unless the scheduler is stopped, it returns whether f is run.
+func (d *duScheduler) start(f func()) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return false
+	}
+	d.runs.Add(1)
+	go func() {
+		defer d.runs.Done()
+		f()
+	}()
+	return true
+}
+
+// duResult is the latest du result of a volume.
+type duResult struct {
+	// stat tracks the du runs that time out
+	stat statState
+
+	lock    sync.Mutex
+	running bool
+	last    time.Time
+	metric  *volume.Metrics
+}
+
+// Get returns the latest du result of the volume and starts a new run in the background when it is due,
+// so the caller is never blocked by du. It returns nil until the first run completes. du runs every
+// interval, or every d.interval if interval is 0.
+func (d *duScheduler) Get(name string, provider *metricsDu, result *duResult, interval time.Duration) *volume.Metrics {
+	result.lock.Lock()
+	defer result.lock.Unlock()
+
+	if interval <= 0 {
+		interval = d.interval
+	}
+	if !result.running && time.Since(result.last) >= interval {
+		result.running = d.start(func() {
+			var metric *volume.Metrics
+			err := d.pool.Run(&result.stat, func() error {
+				// du and find are killed at the deadline, so a slow du on a large volume stops using io
+				ctx, cancel := context.WithTimeout(d.ctx, d.pool.timeout)
+				defer cancel()
+				var err error
+				metric, err = provider.getMetrics(ctx)
+				return err
+			})
+
+			result.lock.Lock()
+			defer result.lock.Unlock()
+			result.running = false
+			result.last = time.Now()
+			if err != nil {
+				if d.ctx.Err() != nil {
+					// du is killed since the exporter is stopping
+					return
+				}
+				klog.Errorf("run du for volume [%s] failed, err: %v", name, err)
+				recordCollectionError(errorReason(classifyStatError(err)))
+				return
+			}
+			result.metric = metric
+		})
+	}
+	return result.metric
+}
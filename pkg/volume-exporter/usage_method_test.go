@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDuKilledAtDeadline(t *testing.T) {
+	// du is run through nice, which hangs like du walking a large export
+	bin := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(bin, "nice"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	const timeout = 100 * time.Millisecond
+	du := newDuScheduler(time.Hour, 1, timeout)
+	defer du.Stop()
+	result := &duResult{}
+
+	start := time.Now()
+	if metric := du.Get("pv/pv-1", newMetricsDu(t.TempDir(), nil), result, 0); metric != nil {
+		t.Fatalf("Get() = %v before du ran", metric)
+	}
+	for {
+		result.lock.Lock()
+		running := result.running
+		result.lock.Unlock()
+		if !running {
+			break
+		}
+		if time.Since(start) > 10*timeout {
+			t.Fatalf("du is still running %v after its deadline of %v", time.Since(start), timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the killed du returns, so the volume does not stay hung
+	deadline := time.Now().Add(10 * timeout)
+	for {
+		result.stat.lock.Lock()
+		hung := result.stat.hung
+		result.stat.lock.Unlock()
+		if !hung {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("du is not killed %v after its deadline of %v", time.Since(start), timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if result.metric != nil {
+		t.Errorf("du killed at its deadline reported %v", result.metric)
+	}
+}
@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	DefaultKubeletRootDir = "/var/lib/kubelet"
+
+	csiPluginName      = "kubernetes.io/csi"
+	emptyDirPluginName = "kubernetes.io/empty-dir"
+
+	// maxSymlinks is the limit of links followed when resolving a block device
+	maxSymlinks = 16
+)
+
+// volumePathResolver finds the directory where kubelet mounts the persistent volume of a pod.
+type volumePathResolver struct {
+	// kubeletRootDir is the --root-dir of kubelet on the host
+	kubeletRootDir string
+	// hostPrefix is where the host filesystem is visible inside the exporter container
+	hostPrefix string
+}
+
+func newVolumePathResolver(kubeletRootDir, hostPrefix string) *volumePathResolver {
+	if kubeletRootDir == "" {
+		kubeletRootDir = DefaultKubeletRootDir
+	}
+	return &volumePathResolver{
+		kubeletRootDir: kubeletRootDir,
+		hostPrefix:     hostPrefix,
+	}
+}
+
+// hostPath converts a path on the host into the path seen by the exporter.
+func (r *volumePathResolver) hostPath(elem ...string) string {
+	return filepath.Join(append([]string{r.hostPrefix}, elem...)...)
+}
+
+// podDir returns the directory of pod under the kubelet root directory.
+func (r *volumePathResolver) podDir(pod *v1.Pod) string {
+	return r.hostPath(r.kubeletRootDir, "pods", string(pod.UID))
+}
+
+// GetPath returns the path kubelet mounts pv at for pod, or the host directory of a hostPath pv. The
+// mounts of the other volumes are found in the mountinfo first, this path is checked when it has none.
+func (r *volumePathResolver) GetPath(pod *v1.Pod, pv *v1.PersistentVolume) (string, error) {
+	// hostPath volumes are not mounted by kubelet, the pod uses the host directory directly
+	if hostPath := pv.Spec.HostPath; hostPath != nil {
+		return r.hostPath(hostPath.Path), nil
+	}
+
+	pluginName, err := getVolumePluginName(pv)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(r.podDir(pod), "volumes", escapePluginName(pluginName), pv.Name)
+	if pluginName == csiPluginName {
+		path = filepath.Join(path, "mount")
+	}
+	return path, nil
+}
+
+// GetEmptyDirPath returns the directory of the emptyDir volume of pod.
+func (r *volumePathResolver) GetEmptyDirPath(pod *v1.Pod, volumeName string) string {
+	return filepath.Join(r.podDir(pod), "volumes", escapePluginName(emptyDirPluginName), volumeName)
+}
+
+// GetDevicePath returns the path of the block device that pv is published to for pod.
+func (r *volumePathResolver) GetDevicePath(pod *v1.Pod, pv *v1.PersistentVolume) (string, error) {
+	pluginName, err := getVolumePluginName(pv)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{
+		filepath.Join(r.podDir(pod), "volumeDevices", escapePluginName(pluginName), pv.Name),
+	}
+	if pluginName == csiPluginName {
+		csiDevicesDir := r.hostPath(r.kubeletRootDir, "plugins", csiPluginName, "volumeDevices")
+		candidates = append(candidates,
+			filepath.Join(csiDevicesDir, "publish", pv.Name, string(pod.UID)),
+			filepath.Join(csiDevicesDir, pv.Name, "dev", string(pod.UID)),
+		)
+	}
+
+	for _, candidate := range candidates {
+		path, err := r.evalHostSymlinks(candidate)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		return path, nil
+	}
+	return "", MountPointNotReady
+}
+
+// evalHostSymlinks follows the symlinks kubelet creates for block devices. Absolute link
+// targets point into the host filesystem, so they are looked up under the host prefix. The device
+// nodes of the host are not mounted into the exporter, so a link to a missing node under /dev is
+// resolved to that node, whose size is then looked up in sysfs by its name.
+func (r *volumePathResolver) evalHostSymlinks(path string) (string, error) {
+	devDir := r.hostPath("/dev")
+	for i := 0; i < maxSymlinks; i++ {
+		info, err := os.Lstat(path)
+		if err != nil {
+			if i > 0 && os.IsNotExist(err) && strings.HasPrefix(path, devDir+"/") {
+				return path, nil
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			path = r.hostPath(target)
+		} else {
+			path = filepath.Join(filepath.Dir(path), target)
+		}
+	}
+	return "", fmt.Errorf("too many links when resolving %s", path)
+}
+
+// getVolumePluginName returns the name of the kubelet volume plugin which mounts pv.
+func getVolumePluginName(pv *v1.PersistentVolume) (string, error) {
+	source := pv.Spec.PersistentVolumeSource
+	switch {
+	case source.CSI != nil:
+		return csiPluginName, nil
+	case source.NFS != nil:
+		return "kubernetes.io/nfs", nil
+	case source.RBD != nil:
+		return "kubernetes.io/rbd", nil
+	case source.CephFS != nil:
+		return "kubernetes.io/cephfs", nil
+	case source.ISCSI != nil:
+		return "kubernetes.io/iscsi", nil
+	case source.FC != nil:
+		return "kubernetes.io/fc", nil
+	case source.Local != nil:
+		return "kubernetes.io/local-volume", nil
+	case source.AWSElasticBlockStore != nil:
+		return "kubernetes.io/aws-ebs", nil
+	case source.GCEPersistentDisk != nil:
+		return "kubernetes.io/gce-pd", nil
+	case source.AzureDisk != nil:
+		return "kubernetes.io/azure-disk", nil
+	case source.AzureFile != nil:
+		return "kubernetes.io/azure-file", nil
+	case source.Glusterfs != nil:
+		return "kubernetes.io/glusterfs", nil
+	case source.Cinder != nil:
+		return "kubernetes.io/cinder", nil
+	case source.VsphereVolume != nil:
+		return "kubernetes.io/vsphere-volume", nil
+	case source.Quobyte != nil:
+		return "kubernetes.io/quobyte", nil
+	case source.PortworxVolume != nil:
+		return "kubernetes.io/portworx-volume", nil
+	case source.ScaleIO != nil:
+		return "kubernetes.io/scaleio", nil
+	case source.StorageOS != nil:
+		return "kubernetes.io/storageos", nil
+	case source.PhotonPersistentDisk != nil:
+		return "kubernetes.io/photon-pd", nil
+	case source.Flocker != nil:
+		return "kubernetes.io/flocker", nil
+	case source.FlexVolume != nil:
+		// flex volumes are registered with the name of their driver, such as "ceph.rook.io/rook"
+		return source.FlexVolume.Driver, nil
+	}
+	return "", fmt.Errorf("unsupported volume source of pv %s", pv.Name)
+}
+
+// escapePluginName escapes the plugin name the same way kubelet does when it creates
+// the plugin directory, e.g. "kubernetes.io/nfs" becomes "kubernetes.io~nfs".
+func escapePluginName(pluginName string) string {
+	return strings.Replace(pluginName, "/", "~", -1)
+}
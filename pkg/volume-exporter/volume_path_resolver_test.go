@@ -0,0 +1,281 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestPV(name string, source v1.PersistentVolumeSource) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.PersistentVolumeSpec{PersistentVolumeSource: source},
+	}
+}
+
+func TestGetPath(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "uid-1"}}
+	podVolumes := "/var/lib/kubelet/pods/uid-1/volumes/"
+
+	tests := []struct {
+		name       string
+		source     v1.PersistentVolumeSource
+		wantPlugin string
+		wantPath   string
+	}{
+		{
+			name:       "csi",
+			source:     v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{Driver: "rbd.csi.ceph.com"}},
+			wantPlugin: "kubernetes.io/csi",
+			wantPath:   podVolumes + "kubernetes.io~csi/pv-1/mount",
+		},
+		{
+			name:       "nfs",
+			source:     v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{}},
+			wantPlugin: "kubernetes.io/nfs",
+			wantPath:   podVolumes + "kubernetes.io~nfs/pv-1",
+		},
+		{
+			name:       "rbd",
+			source:     v1.PersistentVolumeSource{RBD: &v1.RBDPersistentVolumeSource{}},
+			wantPlugin: "kubernetes.io/rbd",
+			wantPath:   podVolumes + "kubernetes.io~rbd/pv-1",
+		},
+		{
+			name:       "cephfs",
+			source:     v1.PersistentVolumeSource{CephFS: &v1.CephFSPersistentVolumeSource{}},
+			wantPlugin: "kubernetes.io/cephfs",
+			wantPath:   podVolumes + "kubernetes.io~cephfs/pv-1",
+		},
+		{
+			name:       "iscsi",
+			source:     v1.PersistentVolumeSource{ISCSI: &v1.ISCSIPersistentVolumeSource{}},
+			wantPlugin: "kubernetes.io/iscsi",
+			wantPath:   podVolumes + "kubernetes.io~iscsi/pv-1",
+		},
+		{
+			name:       "fc",
+			source:     v1.PersistentVolumeSource{FC: &v1.FCVolumeSource{}},
+			wantPlugin: "kubernetes.io/fc",
+			wantPath:   podVolumes + "kubernetes.io~fc/pv-1",
+		},
+		{
+			name:       "local",
+			source:     v1.PersistentVolumeSource{Local: &v1.LocalVolumeSource{Path: "/mnt/disks/ssd1"}},
+			wantPlugin: "kubernetes.io/local-volume",
+			wantPath:   podVolumes + "kubernetes.io~local-volume/pv-1",
+		},
+		{
+			name:       "aws ebs",
+			source:     v1.PersistentVolumeSource{AWSElasticBlockStore: &v1.AWSElasticBlockStoreVolumeSource{}},
+			wantPlugin: "kubernetes.io/aws-ebs",
+			wantPath:   podVolumes + "kubernetes.io~aws-ebs/pv-1",
+		},
+		{
+			name:       "gce pd",
+			source:     v1.PersistentVolumeSource{GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{}},
+			wantPlugin: "kubernetes.io/gce-pd",
+			wantPath:   podVolumes + "kubernetes.io~gce-pd/pv-1",
+		},
+		{
+			name:       "azure disk",
+			source:     v1.PersistentVolumeSource{AzureDisk: &v1.AzureDiskVolumeSource{}},
+			wantPlugin: "kubernetes.io/azure-disk",
+			wantPath:   podVolumes + "kubernetes.io~azure-disk/pv-1",
+		},
+		{
+			name:       "azure file",
+			source:     v1.PersistentVolumeSource{AzureFile: &v1.AzureFilePersistentVolumeSource{}},
+			wantPlugin: "kubernetes.io/azure-file",
+			wantPath:   podVolumes + "kubernetes.io~azure-file/pv-1",
+		},
+		{
+			name:       "glusterfs",
+			source:     v1.PersistentVolumeSource{Glusterfs: &v1.GlusterfsPersistentVolumeSource{}},
+			wantPlugin: "kubernetes.io/glusterfs",
+			wantPath:   podVolumes + "kubernetes.io~glusterfs/pv-1",
+		},
+		{
+			name:       "cinder",
+			source:     v1.PersistentVolumeSource{Cinder: &v1.CinderPersistentVolumeSource{}},
+			wantPlugin: "kubernetes.io/cinder",
+			wantPath:   podVolumes + "kubernetes.io~cinder/pv-1",
+		},
+		{
+			name:       "vsphere",
+			source:     v1.PersistentVolumeSource{VsphereVolume: &v1.VsphereVirtualDiskVolumeSource{}},
+			wantPlugin: "kubernetes.io/vsphere-volume",
+			wantPath:   podVolumes + "kubernetes.io~vsphere-volume/pv-1",
+		},
+		{
+			name:       "quobyte",
+			source:     v1.PersistentVolumeSource{Quobyte: &v1.QuobyteVolumeSource{}},
+			wantPlugin: "kubernetes.io/quobyte",
+			wantPath:   podVolumes + "kubernetes.io~quobyte/pv-1",
+		},
+		{
+			name:       "portworx",
+			source:     v1.PersistentVolumeSource{PortworxVolume: &v1.PortworxVolumeSource{}},
+			wantPlugin: "kubernetes.io/portworx-volume",
+			wantPath:   podVolumes + "kubernetes.io~portworx-volume/pv-1",
+		},
+		{
+			name:       "scaleio",
+			source:     v1.PersistentVolumeSource{ScaleIO: &v1.ScaleIOPersistentVolumeSource{}},
+			wantPlugin: "kubernetes.io/scaleio",
+			wantPath:   podVolumes + "kubernetes.io~scaleio/pv-1",
+		},
+		{
+			name:       "storageos",
+			source:     v1.PersistentVolumeSource{StorageOS: &v1.StorageOSPersistentVolumeSource{}},
+			wantPlugin: "kubernetes.io/storageos",
+			wantPath:   podVolumes + "kubernetes.io~storageos/pv-1",
+		},
+		{
+			name:       "photon pd",
+			source:     v1.PersistentVolumeSource{PhotonPersistentDisk: &v1.PhotonPersistentDiskVolumeSource{}},
+			wantPlugin: "kubernetes.io/photon-pd",
+			wantPath:   podVolumes + "kubernetes.io~photon-pd/pv-1",
+		},
+		{
+			name:       "flocker",
+			source:     v1.PersistentVolumeSource{Flocker: &v1.FlockerVolumeSource{}},
+			wantPlugin: "kubernetes.io/flocker",
+			wantPath:   podVolumes + "kubernetes.io~flocker/pv-1",
+		},
+		{
+			name:       "flex volume is registered with its driver name",
+			source:     v1.PersistentVolumeSource{FlexVolume: &v1.FlexPersistentVolumeSource{Driver: "ceph.rook.io/rook"}},
+			wantPlugin: "ceph.rook.io/rook",
+			wantPath:   podVolumes + "ceph.rook.io~rook/pv-1",
+		},
+		{
+			name:     "host path is used in place",
+			source:   v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/data/pv-1"}},
+			wantPath: "/data/pv-1",
+		},
+	}
+
+	resolver := newVolumePathResolver("", "")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pv := newTestPV("pv-1", test.source)
+			if test.wantPlugin != "" {
+				plugin, err := getVolumePluginName(pv)
+				if err != nil {
+					t.Fatalf("getVolumePluginName() error = %v", err)
+				}
+				if plugin != test.wantPlugin {
+					t.Errorf("getVolumePluginName() = %q, want %q", plugin, test.wantPlugin)
+				}
+			}
+			path, err := resolver.GetPath(pod, pv)
+			if err != nil {
+				t.Fatalf("GetPath() error = %v", err)
+			}
+			if path != test.wantPath {
+				t.Errorf("GetPath() = %q, want %q", path, test.wantPath)
+			}
+		})
+	}
+}
+
+func TestGetPathUnsupportedSource(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "uid-1"}}
+	pv := newTestPV("pv-1", v1.PersistentVolumeSource{})
+
+	if plugin, err := getVolumePluginName(pv); err == nil {
+		t.Errorf("getVolumePluginName() = %q, want an error", plugin)
+	}
+	if path, err := newVolumePathResolver("", "").GetPath(pod, pv); err == nil {
+		t.Errorf("GetPath() = %q, want an error", path)
+	}
+}
+
+func TestGetPathHostPrefix(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "uid-1"}}
+	resolver := newVolumePathResolver("/data/kubelet", "/host")
+
+	tests := []struct {
+		name     string
+		source   v1.PersistentVolumeSource
+		wantPath string
+	}{
+		{
+			name:     "csi",
+			source:   v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{}},
+			wantPath: "/host/data/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pv-1/mount",
+		},
+		{
+			name:     "nfs",
+			source:   v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{}},
+			wantPath: "/host/data/kubelet/pods/uid-1/volumes/kubernetes.io~nfs/pv-1",
+		},
+		{
+			name:     "host path",
+			source:   v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/data/pv-1"}},
+			wantPath: "/host/data/pv-1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := resolver.GetPath(pod, newTestPV("pv-1", test.source))
+			if err != nil {
+				t.Fatalf("GetPath() error = %v", err)
+			}
+			if path != test.wantPath {
+				t.Errorf("GetPath() = %q, want %q", path, test.wantPath)
+			}
+		})
+	}
+}
+
+func TestGetDevicePathToHostDevice(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "uid-1"}}
+	pv := newTestPV("pv-1", v1.PersistentVolumeSource{RBD: &v1.RBDPersistentVolumeSource{}})
+
+	tests := []struct {
+		name string
+		// newResolver returns the resolver and the host root it sees, the exporter runs in the host
+		// namespace if the root is empty
+		newResolver func(t *testing.T) (*volumePathResolver, string)
+	}{
+		{
+			name: "host namespace",
+			newResolver: func(t *testing.T) (*volumePathResolver, string) {
+				return newVolumePathResolver(t.TempDir(), ""), ""
+			},
+		},
+		{
+			name: "host prefix",
+			newResolver: func(t *testing.T) (*volumePathResolver, string) {
+				host := t.TempDir()
+				return newVolumePathResolver("", host), host
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver, host := test.newResolver(t)
+			dir := filepath.Join(resolver.podDir(pod), "volumeDevices", "kubernetes.io~rbd")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			// kubelet links the volume to the device node of the host, which is not mounted into the exporter
+			if err := os.Symlink("/dev/rbd-volume-exporter-test", filepath.Join(dir, "pv-1")); err != nil {
+				t.Fatal(err)
+			}
+
+			path, err := resolver.GetDevicePath(pod, pv)
+			if err != nil {
+				t.Fatalf("GetDevicePath() error = %v", err)
+			}
+			if want := filepath.Join(host, "/dev/rbd-volume-exporter-test"); path != want {
+				t.Errorf("GetDevicePath() = %q, want %q", path, want)
+			}
+		})
+	}
+}
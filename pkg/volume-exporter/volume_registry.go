@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/volume"
+)
+
+// volumeRegistry holds the volumes in use on the node. A volume mounted by many pods, e.g. a
+// ReadWriteMany pvc of a deployment, is registered once and statted once per interval, the pods
+// using it share the result.
+type volumeRegistry struct {
+	// interval is how long a stat result is reused
+	interval time.Duration
+	mounts   *mountTable
+	du       *duScheduler
+	pool     *statPool
+
+	lock    sync.Mutex
+	volumes map[string]*sharedVolume
+}
+
+// sharedVolume is a volume on the node with the pod volumes referencing it.
+type sharedVolume struct {
+	id string
+	// refs are the pod volumes using the volume, keyed by <pod uid>/<volume name>
+	refs     map[string]*podVolumeMetricProvider
+	stat     *statState
+	duResult *duResult
+
+	// lock serializes the stats of the volume, the pods waiting on it get the result of the first one
+	lock   sync.Mutex
+	result *volumeStatResult
+}
+
+// volumeStatResult is the outcome of a stat of a volume.
+type volumeStatResult struct {
+	time time.Time
+	// err is NotMountPoint if the volume is not mounted any more
+	err     error
+	fsStats *FsStats
+	duStats *FsStats
+}
+
+func newVolumeRegistry(interval time.Duration, mounts *mountTable, du *duScheduler, pool *statPool) *volumeRegistry {
+	return &volumeRegistry{
+		interval: interval,
+		mounts:   mounts,
+		du:       du,
+		pool:     pool,
+		volumes:  make(map[string]*sharedVolume),
+	}
+}
+
+// Acquire adds ref to the users of the volume of provider, the volume is registered by its first user.
+func (r *volumeRegistry) Acquire(ref string, provider *podVolumeMetricProvider) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	v, ok := r.volumes[provider.volumeID]
+	if !ok {
+		v = &sharedVolume{
+			id:       provider.volumeID,
+			refs:     make(map[string]*podVolumeMetricProvider),
+			stat:     &statState{},
+			duResult: &duResult{},
+		}
+		r.volumes[v.id] = v
+		klog.Infof("volume [%s] is registered", v.id)
+	}
+	v.refs[ref] = provider
+	provider.shared = v
+}
+
+// Release removes ref from the users of the volume of provider, the volume is unregistered when
+// it has no users left.
+func (r *volumeRegistry) Release(ref string, provider *podVolumeMetricProvider) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	v, ok := r.volumes[provider.volumeID]
+	if !ok {
+		return
+	}
+	delete(v.refs, ref)
+	if len(v.refs) == 0 {
+		delete(r.volumes, v.id)
+		klog.Infof("volume [%s] is unregistered", v.id)
+	}
+}
+
+// Stat returns the stats of the volume of provider. The last result is returned if it is younger
+// than the interval, otherwise the volume is statted through the mount of provider.
+func (r *volumeRegistry) Stat(provider *podVolumeMetricProvider) volumeStatResult {
+	v := provider.shared
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.result != nil && time.Since(v.result.time) < r.interval {
+		return *v.result
+	}
+
+	result := volumeStatResult{time: time.Now()}
+	// the mountpoint check stats the volume as well, so it hangs on a dead mount just like statfs
+	mounted := true
+	var metric *volume.Metrics
+	result.err = r.pool.Run(v.stat, func() error {
+		if provider.mount != nil {
+			var err error
+			if mounted, err = r.mounts.IsMountPoint(provider.mount.mountPoint); err != nil || !mounted {
+				return err
+			}
+		}
+		if provider.method == UsageMethodDu {
+			return nil
+		}
+		var err error
+		metric, err = provider.GetMetrics()
+		return err
+	})
+	if result.err != StatWorkersExhausted && (result.err != StatTimeout || time.Since(result.time) >= r.pool.timeout) {
+		// the volumes which are hung or backing off, or wait for a worker in vain, are not statted at all
+		observeStat(result.time)
+	}
+	if result.err == nil && !mounted {
+		result.err = NotMountPoint
+	}
+	if result.err != nil {
+		// the mount of this pod may be gone while the other pods still have the volume mounted,
+		// so only the successful results are shared
+		result.err = classifyStatError(result.err)
+		v.result = nil
+		return result
+	}
+
+	if metric != nil {
+		fsStats := parseFsStats(metric)
+		result.fsStats = &fsStats
+	}
+	if provider.du != nil {
+		if metric := r.du.Get(v.id, provider.du, v.duResult, provider.duInterval); metric != nil {
+			duStats := parseFsStats(metric)
+			result.duStats = &duStats
+		}
+	}
+	v.result = &result
+	return result
+}
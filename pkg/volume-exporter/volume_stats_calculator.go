@@ -3,23 +3,56 @@ package controller
 import (
 	"fmt"
 	"os"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/volume"
 )
 
 type VolumeStats struct {
 	FsStats
-	Name      string
-	PVCName   string
-	Namespace string
+	Name       string
+	PVCName    string
+	Namespace  string
+	VolumeName string
+	VolumeType string
+	VolumeMode v1.PersistentVolumeMode
+	Medium     v1.StorageMedium
+	// Method is how the usage is calculated, statfs, du or both
+	Method string
+	// DuStats is the latest du result of the volume when Method is du or both
+	DuStats *FsStats
+	// FsType, Device and ReadOnly describe the mount of the volume, they are empty for
+	// volumes which are not mounted
+	FsType   string
+	Device   string
+	ReadOnly bool
+	// NotMounted is set when the mountpoint of the volume is gone, no stats are reported then
+	NotMounted bool
+	// Stale is set when the stat calls on the volume timed out too many times in a row
+	Stale bool
+	// NodeName, StorageClass, PVName, CSIDriver, VolumeHandle and AccessModes are reported as the
+	// extra labels of pvc stats, the last five are empty for volumes without pvc
+	NodeName     string
+	StorageClass string
+	PVName       string
+	CSIDriver    string
+	VolumeHandle string
+	AccessModes  string
+	// Status is the reason why the stats of the volume are missing, it is ok when they are reported
+	Status string
+	// Unresolved is set for the volumes whose pvc, pv or mount is not found, only their status is reported
+	Unresolved bool
+	// LastSuccess is when the stats of the volume were calculated successfully the last time
+	LastSuccess time.Time
+	// StatTimeouts is the number of stat calls on the volume that timed out
+	StatTimeouts uint64
 }
 
 // FsStats contains data about filesystem usage.
@@ -49,124 +82,666 @@ type FsStats struct {
 	InodesUsed *uint64 `json:"inodesUsed,omitempty"`
 }
 
+const (
+	volumeTypePVC       = "persistentVolumeClaim"
+	volumeTypeEmptyDir  = "emptyDir"
+	volumeTypeEphemeral = "ephemeral"
+
+	VolumeNotMountedReason = "VolumeNotMounted" // the event reason when the volume of pod is not mounted
+)
+
+// volumeState is the state of a volume of the pod.
+type volumeState string
+
+const (
+	// VolumePending means the pvc, pv or mount of the volume is not ready yet
+	VolumePending volumeState = "pending"
+	// VolumeReady means the stats of the volume are reported
+	VolumeReady volumeState = "ready"
+	// VolumeFailed means the volume can not be resolved, e.g. its source is not supported
+	VolumeFailed volumeState = "failed"
+	// VolumeStale means the stat calls on the volume time out repeatedly
+	VolumeStale volumeState = "stale"
+
+	minVolumeRetry = time.Second
+	maxVolumeRetry = 2 * time.Minute
+)
+
+// podVolume tracks a volume of the pod from discovery until it is ready to be collected.
+type podVolume struct {
+	state    volumeState
+	err      error
+	provider *podVolumeMetricProvider
+	retries  int
+	retryAt  time.Time
+	// resolving is set while the volume is resolved without holding the lock
+	resolving bool
+	// epoch changes when the volume must be resolved again, a resolution started before is discarded
+	epoch int
+}
+
 type volumesMetricProvider struct {
-	pod       *v1.Pod
-	providers map[string]volume.MetricsProvider
+	pod      *v1.Pod
+	resolve  func(pod *v1.Pod, vol v1.Volume) (*podVolumeMetricProvider, error)
+	registry *volumeRegistry
+
+	lock     sync.Mutex
+	specs    map[string]v1.Volume
+	volumes  map[string]*podVolume
+	released bool
+}
+
+// Reconcile resolves the volumes which are not ready when their backoff expires. It returns the
+// providers of the volumes whose stats can be collected, and the errors of the other volumes.
+func (p *volumesMetricProvider) Reconcile() (map[string]*podVolumeMetricProvider, map[string]error) {
+	p.resolveDue()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	providers := make(map[string]*podVolumeMetricProvider)
+	failures := make(map[string]error)
+	if p.released {
+		return providers, failures
+	}
+	for name, vol := range p.volumes {
+		if vol.provider == nil {
+			failures[name] = vol.err
+			continue
+		}
+
+		vol.state = VolumeReady
+		if vol.provider.shared.stat.Stale() {
+			vol.state = VolumeStale
+		}
+		providers[name] = vol.provider
+	}
+	return providers, failures
+}
+
+// resolveDue resolves the volumes which are not ready and whose backoff expired. The lock is not held
+// while they are resolved since resolving stats their paths, which hangs on a dead mount, and the
+// workers and the scrapes must not wait for it.
+func (p *volumesMetricProvider) resolveDue() {
+	type dueVolume struct {
+		name  string
+		spec  v1.Volume
+		epoch int
+	}
+	var due []dueVolume
+
+	p.lock.Lock()
+	now := time.Now()
+	if !p.released {
+		for name, vol := range p.volumes {
+			if vol.provider == nil && !vol.resolving && !now.Before(vol.retryAt) {
+				vol.resolving = true
+				due = append(due, dueVolume{name: name, spec: p.specs[name], epoch: vol.epoch})
+			}
+		}
+	}
+	p.lock.Unlock()
+
+	for _, d := range due {
+		provider, err := p.resolve(p.pod, d.spec)
+		p.setResolved(d.name, d.epoch, provider, err)
+	}
+}
+
+// setResolved records the result of resolving the volume name, it is discarded if the pod is released
+// or the volume must be resolved again meanwhile.
+func (p *volumesMetricProvider) setResolved(name string, epoch int, provider *podVolumeMetricProvider, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	vol := p.volumes[name]
+	vol.resolving = false
+	if p.released || vol.epoch != epoch {
+		return
+	}
+	if err != nil {
+		now := time.Now()
+		vol.err = err
+		vol.state = VolumeFailed
+		if isVolumePending(err) {
+			vol.state = VolumePending
+		}
+		recordCollectionError(errorReason(err))
+		vol.retries++
+		vol.retryAt = now.Add(volumeRetryBackoff(vol.retries))
+		klog.Infof("volume [%s] of pod [%s/%s] is %s, retry in %v, err: %v", name, p.pod.Namespace, p.pod.Name, vol.state, vol.retryAt.Sub(now), err)
+		return
+	}
+	p.registry.Acquire(p.volumeRef(name), provider)
+	vol.provider, vol.err, vol.retries = provider, nil, 0
+	klog.Infof("volume [%s] of pod [%s/%s] is ready", name, p.pod.Namespace, p.pod.Name)
+}
+
+// lastUpdate returns when the latest stats of the volume were measured, it is zero if there are none.
+func (vs VolumeStats) lastUpdate() time.Time {
+	lastUpdate := vs.FsStats.Time.Time
+	if vs.DuStats != nil && vs.DuStats.Time.After(lastUpdate) {
+		lastUpdate = vs.DuStats.Time.Time
+	}
+	return lastUpdate
 }
 
+// AddVolumes starts to track the volumes in specs which are not tracked yet, e.g. a generic ephemeral
+// volume whose pvc shows up after the pod.
+func (p *volumesMetricProvider) AddVolumes(specs map[string]v1.Volume) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.released {
+		return
+	}
+	for name, vol := range specs {
+		if _, ok := p.volumes[name]; ok {
+			continue
+		}
+		klog.Infof("new volume [%s] found for pod [%s/%s]", name, p.pod.Namespace, p.pod.Name)
+		p.specs[name] = vol
+		// the volume is reported as not ready until it is resolved
+		p.volumes[name] = &podVolume{state: VolumePending, err: MountPointNotReady}
+	}
+}
+
+// spec returns the spec of the volume of the pod.
+func (p *volumesMetricProvider) spec(name string) v1.Volume {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.specs[name]
+}
+
+// CountStates adds the number of volumes of the pod in each state to counts.
+func (p *volumesMetricProvider) CountStates(counts map[volumeState]int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, vol := range p.volumes {
+		counts[vol.state]++
+	}
+}
+
+// RetryNow makes the volumes which are not ready be resolved in the next Reconcile, it is called
+// when their pvc or pv changes.
+func (p *volumesMetricProvider) RetryNow() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, vol := range p.volumes {
+		vol.retryAt = time.Time{}
+	}
+}
+
+// ResolveClaimAgain drops the volumes resolved from the pvc named claimName, they are resolved
+// again in the next Reconcile so the changes of the pvc, e.g. its usage method, take effect.
+func (p *volumesMetricProvider) ResolveClaimAgain(claimName string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.released {
+		return
+	}
+	for name, vol := range p.volumes {
+		if vol.resolving {
+			// it may be resolved from the pvc before the change
+			vol.epoch++
+			continue
+		}
+		if vol.provider == nil || vol.provider.pvcName != claimName {
+			continue
+		}
+		p.registry.Release(p.volumeRef(name), vol.provider)
+		vol.provider, vol.state, vol.err, vol.retries, vol.retryAt = nil, VolumePending, MountPointNotReady, 0, time.Time{}
+		vol.epoch++
+	}
+}
+
+// Release releases the volumes of the pod from the registry, no volume is resolved afterwards.
+func (p *volumesMetricProvider) Release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.released = true
+	for name, vol := range p.volumes {
+		if vol.provider != nil {
+			p.registry.Release(p.volumeRef(name), vol.provider)
+		}
+	}
+}
+
+// volumeRef identifies the volume of the pod among the users of a shared volume.
+func (p *volumesMetricProvider) volumeRef(name string) string {
+	return string(p.pod.UID) + "/" + name
+}
+
+// volumeRetryBackoff doubles the delay with every failed retry, up to maxVolumeRetry.
+func volumeRetryBackoff(retries int) time.Duration {
+	backoff := minVolumeRetry
+	for i := 1; i < retries && backoff < maxVolumeRetry; i++ {
+		backoff *= 2
+	}
+	if backoff > maxVolumeRetry {
+		backoff = maxVolumeRetry
+	}
+	return backoff
+}
+
+// podVolumeMetricProvider collects the metrics of a single volume of the pod.
+type podVolumeMetricProvider struct {
+	volume.MetricsProvider
+	volumeType string
+	volumeMode v1.PersistentVolumeMode
+	pvcName    string
+	medium     v1.StorageMedium
+	// mount is nil for volumes which are not mounted, e.g. block volumes
+	mount *mountInfo
+	// method is the usage method of the volume, it is empty for block volumes
+	method string
+	// du is set for the volumes whose usage is calculated with du
+	du *metricsDu
+	// duInterval is how often du runs for the volume, the du interval of the controller is used if it is 0
+	duInterval time.Duration
+	// claim is set for the volumes with pvc
+	claim claimInfo
+	// volumeID identifies the volume on the node, the pods using the same pv share its stats
+	volumeID string
+	shared   *sharedVolume
+}
+
+// claimInfo describes the pvc and pv of a volume.
+type claimInfo struct {
+	storageClass string
+	pvName       string
+	csiDriver    string
+	volumeHandle string
+	accessModes  string
+}
+
+func newClaimInfo(pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) claimInfo {
+	info := claimInfo{
+		storageClass: getStorageClassName(pvc),
+		pvName:       pv.Name,
+	}
+	if csi := pv.Spec.CSI; csi != nil {
+		info.csiDriver, info.volumeHandle = csi.Driver, csi.VolumeHandle
+	}
+	// the status holds the access modes the volume actually has, the spec the requested ones
+	accessModes := pvc.Status.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = pvc.Spec.AccessModes
+	}
+	modes := make([]string, 0, len(accessModes))
+	for _, mode := range accessModes {
+		modes = append(modes, string(mode))
+	}
+	info.accessModes = strings.Join(modes, ",")
+	return info
+}
+
+// setUsageMethod sets how the usage of the volume mounted at path is calculated, capacity is the size
+// of the volume reported along with the du usage, it is nil if unknown.
+func (p *podVolumeMetricProvider) setUsageMethod(method string, path string, capacity *resource.Quantity) {
+	p.method = method
+	if method == UsageMethodDu || method == UsageMethodBoth {
+		p.du = newMetricsDu(path, capacity)
+	}
+}
+
+// volumeStatCalculator calculates the stats of the volumes of a pod, it is run by the collectScheduler.
 type volumeStatCalculator struct {
-	provider     *volumesMetricProvider
-	jitterPeriod time.Duration
-	pod          *v1.Pod
-	stopChannel  chan struct{}
-	startO       sync.Once
-	stopO        sync.Once
-	latest       atomic.Value
+	provider *volumesMetricProvider
+	pod      *v1.Pod
+	registry *volumeRegistry
+	recorder record.EventRecorder
+	store    *statsStore
+	key      string
+
+	// notMounted holds the volumes found not mounted in the last check
+	notMounted map[string]bool
+	// lastSuccess holds when the stats of the volumes were calculated successfully the last time
+	lastSuccess map[string]time.Time
 }
 
-func newVolumesMetricProvider(cli *kubernetes.Clientset, pod *v1.Pod) (*volumesMetricProvider, error) {
-	providers := make(map[string]volume.MetricsProvider)
+// newVolumesMetricProvider creates the metric provider for the volumes of pod. Besides pvcs, emptyDir
+// and generic ephemeral volumes are collected if c.collectEphemeral is set. The volumes are resolved
+// one by one later, so a volume that is not ready does not hold back the others.
+func (c *VolumeController) newVolumesMetricProvider(pod *v1.Pod) *volumesMetricProvider {
+	provider := &volumesMetricProvider{
+		pod:      pod,
+		resolve:  c.newPodVolumeMetricProvider,
+		specs:    make(map[string]v1.Volume),
+		registry: c.registry,
+		volumes:  make(map[string]*podVolume),
+	}
+	provider.AddVolumes(c.collectedVolumes(pod))
+	return provider
+}
+
+// collectedVolumes returns the volumes of pod whose stats are collected, keyed by name.
+func (c *VolumeController) collectedVolumes(pod *v1.Pod) map[string]v1.Volume {
+	specs := make(map[string]v1.Volume)
 	for _, vol := range pod.Spec.Volumes {
-		if claim := vol.VolumeSource.PersistentVolumeClaim; claim != nil {
-			klog.Infof("new pvc [%s] found for pod [%s/%s]", claim.ClaimName, pod.Namespace, pod.Name)
-			pvc, err := cli.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(claim.ClaimName, metav1.GetOptions{})
-			if err != nil {
-				klog.Errorf("find pvc info from apiserver failed, err: %v", err)
-				return nil, PVCNotFound
+		collected := vol.VolumeSource.PersistentVolumeClaim != nil
+		if !collected && c.collectEphemeral {
+			collected = vol.VolumeSource.EmptyDir != nil || c.hasEphemeralVolumeClaim(pod, vol)
+		}
+		if collected {
+			specs[vol.Name] = vol
+		}
+	}
+	return specs
+}
+
+// hasEphemeralVolumeClaim returns whether vol is a generic ephemeral volume of pod. The vendored API
+// drops every source it does not know, e.g. inline csi volumes as well, so a volume without source
+// is only taken for an ephemeral one once the pvc controlled by the pod exists.
+func (c *VolumeController) hasEphemeralVolumeClaim(pod *v1.Pod, vol v1.Volume) bool {
+	if vol.VolumeSource != (v1.VolumeSource{}) {
+		return false
+	}
+	_, err := c.getEphemeralVolumeClaim(pod, vol)
+	return err == nil
+}
+
+// newPodVolumeMetricProvider creates the metric provider for a volume of pod.
+func (c *VolumeController) newPodVolumeMetricProvider(pod *v1.Pod, vol v1.Volume) (*podVolumeMetricProvider, error) {
+	if claim := vol.VolumeSource.PersistentVolumeClaim; claim != nil {
+		pvc, err := c.pvcLister.PersistentVolumeClaims(pod.Namespace).Get(claim.ClaimName)
+		if err != nil {
+			klog.Errorf("find pvc info from informer cache failed, err: %v", err)
+			return nil, PVCNotFound
+		}
+		provider, err := c.newPVCMetricProvider(pod, pvc)
+		if err != nil {
+			return nil, err
+		}
+		provider.volumeType = volumeTypePVC
+		return provider, nil
+	}
+
+	if emptyDir := vol.VolumeSource.EmptyDir; emptyDir != nil {
+		provider := &podVolumeMetricProvider{
+			volumeType: volumeTypeEmptyDir,
+			volumeMode: v1.PersistentVolumeFilesystem,
+			medium:     emptyDir.Medium,
+			volumeID:   "pod/" + string(pod.UID) + "/" + vol.Name,
+		}
+		if emptyDir.Medium == v1.StorageMediumMemory {
+			// memory backed emptyDir is a tmpfs of its own
+			mount, ok := c.mounts.Lookup(pod.UID, vol.Name)
+			if !ok {
+				klog.Errorf("pod [%s/%s] is watched, but tmpfs of emptyDir [%s] is not mounted", pod.Namespace, pod.Name, vol.Name)
+				return nil, MountPointNotReady
 			}
-			path := getPath(pod, pvc)
+			provider.MetricsProvider = newMetricsStatFS(mount.mountPoint)
+			provider.mount = mount
+			provider.setUsageMethod(UsageMethodStatFS, mount.mountPoint, nil)
+		} else {
+			path := c.resolver.GetEmptyDirPath(pod, vol.Name)
 			if _, err := os.Stat(path); os.IsNotExist(err) {
-				klog.Errorf("pod [%s/%s] is watched, but mountpoint for pvc [%s] is not created, which is %s", pod.Namespace, pod.Name, pvc.Name, path)
+				klog.Errorf("pod [%s/%s] is watched, but emptyDir [%s] is not created, which is %s", pod.Namespace, pod.Name, vol.Name, path)
 				return nil, MountPointNotReady
 			}
-			providers[pvc.Name] = volume.NewMetricsStatFS(path)
+			// disk backed emptyDir shares the filesystem of kubelet root dir, only du tells its usage.
+			// Its size limit is what kubelet evicts the pod on, so it is reported as the capacity.
+			provider.setUsageMethod(UsageMethodDu, path, emptyDir.SizeLimit)
+			provider.duInterval = c.emptyDirDuInterval
 		}
+		return provider, nil
 	}
 
-	p := &volumesMetricProvider{
-		pod:       pod,
-		providers: providers,
+	pvc, err := c.getEphemeralVolumeClaim(pod, vol)
+	if err != nil {
+		return nil, err
 	}
-	return p, nil
+	provider, err := c.newPVCMetricProvider(pod, pvc)
+	if err != nil {
+		return nil, err
+	}
+	provider.volumeType = volumeTypeEphemeral
+	return provider, nil
 }
 
-func newVolumeStatCalculator(provider *volumesMetricProvider, jitterPeriod time.Duration, pod *v1.Pod) *volumeStatCalculator {
+// newPVCMetricProvider creates the metric provider for the pv that pvc is bound to.
+func (c *VolumeController) newPVCMetricProvider(pod *v1.Pod, pvc *v1.PersistentVolumeClaim) (*podVolumeMetricProvider, error) {
+	if pvc.Spec.VolumeName == "" {
+		klog.Errorf("pvc [%s/%s] is not bound to any pv yet", pvc.Namespace, pvc.Name)
+		return nil, PVCUnbound
+	}
+	pv, err := c.pvLister.Get(pvc.Spec.VolumeName)
+	if err != nil {
+		klog.Errorf("find pv info from informer cache failed, err: %v", err)
+		return nil, PVNotFound
+	}
+	provider, err := c.newPVMetricProvider(pod, pvc, pv)
+	if err != nil {
+		return nil, err
+	}
+	provider.pvcName = pvc.Name
+	provider.claim = newClaimInfo(pvc, pv)
+	provider.volumeID = "pv/" + pv.Name
+	return provider, nil
+}
 
-	return &volumeStatCalculator{
-		provider:     provider,
-		jitterPeriod: jitterPeriod,
-		pod:          pod,
-		stopChannel:  make(chan struct{}),
+// newPVMetricProvider creates the metric provider for pv, which is a block device, a host path or
+// a filesystem mounted by kubelet.
+func (c *VolumeController) newPVMetricProvider(pod *v1.Pod, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) (*podVolumeMetricProvider, error) {
+	if getVolumeMode(pv) == v1.PersistentVolumeBlock {
+		path, err := c.resolver.GetDevicePath(pod, pv)
+		if err != nil {
+			klog.Errorf("pod [%s/%s] is watched, but block device for pvc [%s] is not found, err: %v", pod.Namespace, pod.Name, pvc.Name, err)
+			return nil, err
+		}
+		return &podVolumeMetricProvider{
+			MetricsProvider: newMetricsBlock(path),
+			volumeMode:      v1.PersistentVolumeBlock,
+		}, nil
+	}
+
+	if pv.Spec.HostPath != nil {
+		// hostPath volumes are used in place and never show up in the mount table
+		path, err := c.resolver.GetPath(pod, pv)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			klog.Errorf("pod [%s/%s] is watched, but host path for pvc [%s] does not exist, which is %s", pod.Namespace, pod.Name, pvc.Name, path)
+			return nil, MountPointNotReady
+		}
+		provider := &podVolumeMetricProvider{
+			MetricsProvider: newMetricsStatFS(path),
+			volumeMode:      v1.PersistentVolumeFilesystem,
+		}
+		provider.setUsageMethod(c.getUsageMethod(pvc), path, claimCapacity(pvc))
+		return provider, nil
 	}
+
+	mount, ok := c.mounts.Lookup(pod.UID, pv.Name)
+	if !ok {
+		mount, ok = c.lookupVolumePath(pod, pv)
+	}
+	if !ok {
+		klog.Errorf("pod [%s/%s] is watched, but pv [%s] of pvc [%s] is not mounted", pod.Namespace, pod.Name, pv.Name, pvc.Name)
+		return nil, MountPointNotReady
+	}
+	provider := &podVolumeMetricProvider{
+		MetricsProvider: newMetricsStatFS(mount.mountPoint),
+		volumeMode:      v1.PersistentVolumeFilesystem,
+		mount:           mount,
+	}
+	provider.setUsageMethod(c.getUsageMethod(pvc), mount.mountPoint, claimCapacity(pvc))
+	return provider, nil
 }
 
-// StartOnce starts pod volume calc that will occur periodically in the background until s.StopOnce is called
-func (s *volumeStatCalculator) StartOnce() *volumeStatCalculator {
-	s.startO.Do(func() {
-		go wait.JitterUntil(func() {
-			s.calcAndStoreStats()
-		}, s.jitterPeriod, 1.0, true, s.stopChannel)
-	})
-	return s
+// lookupVolumePath finds the mount of pv at the path kubelet mounts it at for pod, for the volumes
+// the mountinfo has no entry of, e.g. when the kubelet root dir is a symlink the mountinfo has the
+// paths it points to. The filesystem type and the source of such a mount are not known.
+func (c *VolumeController) lookupVolumePath(pod *v1.Pod, pv *v1.PersistentVolume) (*mountInfo, bool) {
+	path, err := c.resolver.GetPath(pod, pv)
+	if err != nil {
+		klog.Errorf("get mount path of pv [%s] failed, err: %v", pv.Name, err)
+		return nil, false
+	}
+	if mounted, err := c.mounts.IsMountPoint(path); err != nil || !mounted {
+		return nil, false
+	}
+	klog.Infof("pv [%s] is not in mountinfo, but is mounted at %s", pv.Name, path)
+	return &mountInfo{mountPoint: path}, true
 }
 
-// StopOnce stops background pod volume calculation.  Will not stop a currently executing calculations until
-// they complete their current iteration.
-func (s *volumeStatCalculator) StopOnce() *volumeStatCalculator {
-	s.stopO.Do(func() {
-		close(s.stopChannel)
-	})
-	return s
+// getEphemeralVolumeClaim returns the pvc that kubelet created for a generic ephemeral volume of pod.
+// The vendored API predates the ephemeral volume source, so such a volume shows up without any source
+// and is recognized by the pvc named <pod>-<volume> which is controlled by the pod.
+func (c *VolumeController) getEphemeralVolumeClaim(pod *v1.Pod, vol v1.Volume) (*v1.PersistentVolumeClaim, error) {
+	pvc, err := c.pvcLister.PersistentVolumeClaims(pod.Namespace).Get(pod.Name + "-" + vol.Name)
+	if err != nil {
+		return nil, PVCNotFound
+	}
+	if owner := metav1.GetControllerOf(pvc); owner == nil || owner.UID != pod.UID {
+		return nil, fmt.Errorf("volume %s has no supported source and pvc %s is not owned by the pod", vol.Name, pvc.Name)
+	}
+	return pvc, nil
 }
 
-// getLatest returns the most recent PodVolumeStats from the cache
-func (s *volumeStatCalculator) GetLatest() ([]VolumeStats, bool) {
-	if result := s.latest.Load(); result == nil {
-		return []VolumeStats{}, false
-	} else {
-		return result.([]VolumeStats), true
+func newVolumeStatCalculator(provider *volumesMetricProvider, pod *v1.Pod, registry *volumeRegistry, recorder record.EventRecorder, store *statsStore, key string) *volumeStatCalculator {
+
+	return &volumeStatCalculator{
+		provider:    provider,
+		pod:         pod,
+		registry:    registry,
+		recorder:    recorder,
+		store:       store,
+		key:         key,
+		notMounted:  make(map[string]bool),
+		lastSuccess: make(map[string]time.Time),
 	}
 }
 
-// calcAndStoreStats calculates PodVolumeStats for a given pod and writes the result to the s.latest cache.
+// calcAndStoreStats calculates PodVolumeStats for a given pod and writes the result to the stats store.
 // If the pod references PVCs, the prometheus metrics for those are updated with the result.
 func (s *volumeStatCalculator) calcAndStoreStats() {
 
 	// Call GetMetrics on each Volume and copy the result to a new VolumeStats.FsStats
 	volumesStats := make([]VolumeStats, 0)
-	for pvcname, provider := range s.provider.providers {
-		metric, err := provider.GetMetrics()
-		if err != nil {
-			klog.Errorf("get metrics pvc [%s] of pod [%s/%s] failed, err: %s", pvcname, s.pod.Namespace, s.pod.Name, err)
-			continue
-		}
+	providers, failures := s.provider.Reconcile()
+	for volumeName, err := range failures {
+		volumesStats = append(volumesStats, s.newUnresolvedVolumeStats(volumeName, err))
+	}
+	for volumeName, provider := range providers {
+		volumeStats := s.newPodVolumeStats(s.pod.Name, s.pod.Namespace, volumeName, provider)
 
-		volumeStats := s.parsePodVolumeStats(s.pod.Name, pvcname, s.pod.Namespace, metric)
+		// the pods using the same volume share its stats, so it is statted once per interval
+		result := s.registry.Stat(provider)
+		volumeStats.Stale = provider.shared.stat.Stale()
+		volumeStats.StatTimeouts = provider.shared.stat.TotalTimeouts()
+
+		switch {
+		case isStatTimeout(result.err):
+			klog.Errorf("stat volume [%s] of pod [%s/%s] timed out, stale: %v", volumeName, s.pod.Namespace, s.pod.Name, volumeStats.Stale)
+		case result.err == NotMountPoint:
+			// statfs on the bare directory would report the filesystem below it, e.g. the node root
+			s.reportNotMounted(volumeName, provider)
+			volumeStats.NotMounted = true
+		case result.err != nil:
+			klog.Errorf("get metrics of volume [%s] of pod [%s/%s] failed, err: %s", volumeName, s.pod.Namespace, s.pod.Name, result.err)
+		default:
+			s.notMounted[volumeName] = false
+			s.lastSuccess[volumeName] = result.time
+			if result.fsStats != nil {
+				volumeStats.FsStats = *result.fsStats
+			}
+			volumeStats.DuStats = result.duStats
+		}
+		if result.err != nil {
+			recordCollectionError(errorReason(result.err))
+		}
+		volumeStats.Status = errorReason(result.err)
+		volumeStats.LastSuccess = s.lastSuccess[volumeName]
 		volumesStats = append(volumesStats, volumeStats)
 	}
 
 	// Store the new stats
-	s.latest.Store(volumesStats)
+	s.store.Update(s.key, s.pod.UID, volumesStats)
+}
+
+// newUnresolvedVolumeStats creates the stats of a volume which is not resolved because of err, only
+// its status is reported.
+func (s *volumeStatCalculator) newUnresolvedVolumeStats(volumeName string, err error) VolumeStats {
+	volumeStats := VolumeStats{
+		Name:       s.pod.Name,
+		Namespace:  s.pod.Namespace,
+		VolumeName: volumeName,
+		NodeName:   s.pod.Spec.NodeName,
+		Status:     errorReason(err),
+		Unresolved: true,
+	}
+	vol := s.provider.spec(volumeName)
+	switch {
+	case vol.PersistentVolumeClaim != nil:
+		volumeStats.VolumeType, volumeStats.PVCName = volumeTypePVC, vol.PersistentVolumeClaim.ClaimName
+	case vol.EmptyDir != nil:
+		volumeStats.VolumeType = volumeTypeEmptyDir
+	default:
+		volumeStats.VolumeType, volumeStats.PVCName = volumeTypeEphemeral, s.pod.Name+"-"+volumeName
+	}
+	return volumeStats
+}
+
+// reportNotMounted records an event for the pod when the volume is found not mounted.
+func (s *volumeStatCalculator) reportNotMounted(volumeName string, provider *podVolumeMetricProvider) {
+	if !s.notMounted[volumeName] {
+		klog.Warningf("volume [%s] of pod [%s/%s] is not mounted at %s", volumeName, s.pod.Namespace, s.pod.Name, provider.mount.mountPoint)
+		s.recorder.Eventf(s.pod, v1.EventTypeWarning, VolumeNotMountedReason,
+			"Volume %s is not mounted at %s, its stats are not reported", volumeName, provider.mount.mountPoint)
+	}
+	s.notMounted[volumeName] = true
 }
 
-// parsePodVolumeStats converts (internal) volume.Metrics to (external) stats.VolumeStats structures
-func (s *volumeStatCalculator) parsePodVolumeStats(podName string, pvcName string, namespace string, metric *volume.Metrics) VolumeStats {
-	available := uint64(metric.Available.Value())
-	capacity := uint64(metric.Capacity.Value())
-	used := uint64(metric.Used.Value())
-	inodes := uint64(metric.Inodes.Value())
-	inodesFree := uint64(metric.InodesFree.Value())
-	inodesUsed := uint64(metric.InodesUsed.Value())
+// parseFsStats converts (internal) volume.Metrics to (external) FsStats structures.
+// Metrics that the provider does not report, such as inodes of a block device, are left nil.
+func parseFsStats(metric *volume.Metrics) FsStats {
+	return FsStats{Time: metric.Time, AvailableBytes: quantityToUint64(metric.Available), CapacityBytes: quantityToUint64(metric.Capacity),
+		UsedBytes: quantityToUint64(metric.Used), Inodes: quantityToUint64(metric.Inodes), InodesFree: quantityToUint64(metric.InodesFree), InodesUsed: quantityToUint64(metric.InodesUsed)}
+}
 
+// newPodVolumeStats returns the VolumeStats which describes the volume without any stats.
+func (s *volumeStatCalculator) newPodVolumeStats(podName string, namespace string, volumeName string, provider *podVolumeMetricProvider) VolumeStats {
+	var fsType, device string
+	var readOnly bool
+	if mount := provider.mount; mount != nil {
+		fsType, device, readOnly = mount.fsType, mount.source, mount.readOnly
+	}
 	return VolumeStats{
-		Name:      podName,
-		PVCName:   pvcName,
-		Namespace: namespace,
-		FsStats: FsStats{Time: metric.Time, AvailableBytes: &available, CapacityBytes: &capacity,
-			UsedBytes: &used, Inodes: &inodes, InodesFree: &inodesFree, InodesUsed: &inodesUsed},
+		Name:       podName,
+		PVCName:    provider.pvcName,
+		Namespace:  namespace,
+		VolumeName: volumeName,
+		VolumeType: provider.volumeType,
+		VolumeMode: provider.volumeMode,
+		Medium:     provider.medium,
+		Method:     provider.method,
+		FsType:     fsType,
+		Device:     device,
+		ReadOnly:   readOnly,
+
+		NodeName:     s.pod.Spec.NodeName,
+		StorageClass: provider.claim.storageClass,
+		PVName:       provider.claim.pvName,
+		CSIDriver:    provider.claim.csiDriver,
+		VolumeHandle: provider.claim.volumeHandle,
+		AccessModes:  provider.claim.accessModes,
 	}
 }
 
-func getPath(pod *v1.Pod, pvc *v1.PersistentVolumeClaim) string {
-	return fmt.Sprintf("/var/lib/kubelet/pods/%s/volumes/kubernetes.io~csi/%s/mount", pod.UID, pvc.Spec.VolumeName)
+func quantityToUint64(q *resource.Quantity) *uint64 {
+	if q == nil {
+		return nil
+	}
+	v := uint64(q.Value())
+	return &v
+}
+
+// getVolumeMode returns the volume mode of pv, which defaults to Filesystem.
+func getVolumeMode(pv *v1.PersistentVolume) v1.PersistentVolumeMode {
+	if pv.Spec.VolumeMode == nil {
+		return v1.PersistentVolumeFilesystem
+	}
+	return *pv.Spec.VolumeMode
 }